@@ -0,0 +1,216 @@
+package lua
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ChunkCache keeps the bytecode of the chunks loaded by the states using it,
+// so that a source is compiled once and then loaded from its bytecode. It
+// can be shared by states running on different goroutines.
+//
+// Chunks are keyed by a hash of the Lua release, the chunk name and the
+// source. In memory the least recently used chunks are dropped once their
+// bytecode goes over the size of the cache, see SetMaxSize. With a directory
+// the bytecode of the chunks named after a file ("@path"), like the ones
+// loaded by LoadFile and DoFile, is also stored there and survives the
+// process. Other chunks are only kept in memory.
+//
+// Lua does not verify bytecode and malformed bytecode can crash the process,
+// the files found in the directory are loaded as is. Only use a directory
+// that nobody else can write to.
+type ChunkCache struct {
+	dir     string
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	// Most recently used chunks first
+	lru    *list.List
+	chunks map[string]*list.Element
+}
+
+type cachedChunk struct {
+	key string
+	bc  []byte
+}
+
+// DefaultChunkCacheSize is the size of the bytecode a new ChunkCache keeps in
+// memory.
+const DefaultChunkCacheSize = 16 << 20
+
+// NewChunkCache returns a cache of compiled chunks kept in memory and, when
+// dir is not empty, in files in dir, which is created if needed.
+func NewChunkCache(dir string) (*ChunkCache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &ChunkCache{
+		dir:     dir,
+		maxSize: DefaultChunkCacheSize,
+		lru:     list.New(),
+		chunks:  make(map[string]*list.Element),
+	}, nil
+}
+
+// SetMaxSize sets the most bytes of bytecode kept in memory, dropping the
+// least recently used chunks over it. Files in the directory are not
+// removed.
+func (c *ChunkCache) SetMaxSize(bytes int) {
+	c.mu.Lock()
+	c.maxSize = bytes
+	c.evict()
+	c.mu.Unlock()
+}
+
+// WithChunkCache makes the state load its chunks through c, see
+// SetChunkCache.
+func WithChunkCache(c *ChunkCache) Option {
+	return func(L *LuaState) {
+		L.SetChunkCache(c)
+	}
+}
+
+// SetChunkCache makes LoadBuffer, LoadString, LoadFile and the functions
+// built on them (DoString, DoFile, ...) load source chunks through c, nil
+// stops using a cache. Binary chunks and chunks loaded with mode "b" are not
+// cached.
+func (l *LuaState) SetChunkCache(c *ChunkCache) {
+	l.chunkCache = c
+}
+
+// cacheable reports whether the chunk src loaded with mode can go through
+// the cache.
+func cacheable(src []byte, mode string) bool {
+	return !bytes.HasPrefix(src, []byte(LUA_SIGNATURE[:1])) && (mode == "" || strings.Contains(mode, "t"))
+}
+
+func (c *ChunkCache) key(src []byte, name string) string {
+	h := sha256.New()
+	h.Write([]byte(LUA_RELEASE + "\x00" + name + "\x00"))
+	h.Write(src)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *ChunkCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.chunks[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if ok {
+		return e.Value.(*cachedChunk).bc, true
+	}
+	if c.dir == "" {
+		return nil, false
+	}
+	bc, err := ioutil.ReadFile(filepath.Join(c.dir, key+".luac"))
+	if err != nil {
+		return nil, false
+	}
+	c.keep(key, bc)
+	return bc, true
+}
+
+// keep adds bc to the chunks in memory.
+func (c *ChunkCache) keep(key string, bc []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.chunks[key]; ok {
+		c.size -= len(e.Value.(*cachedChunk).bc)
+		c.lru.Remove(e)
+	}
+	c.chunks[key] = c.lru.PushFront(&cachedChunk{key, bc})
+	c.size += len(bc)
+	c.evict()
+}
+
+// evict drops the least recently used chunks until the cache fits its size.
+func (c *ChunkCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		e := c.lru.Back()
+		cc := e.Value.(*cachedChunk)
+		c.lru.Remove(e)
+		delete(c.chunks, cc.key)
+		c.size -= len(cc.bc)
+	}
+}
+
+// put stores bc, in the directory too when persist is true. Failing to
+// write it there only costs a compile in the next process.
+func (c *ChunkCache) put(key string, bc []byte, persist bool) {
+	c.keep(key, bc)
+	if c.dir == "" || !persist {
+		return
+	}
+	// Write then rename so other processes never read a partial file
+	f, err := ioutil.TempFile(c.dir, key+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(bc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, key+".luac"))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+// load loads the source chunk src on l from its bytecode when cached, or
+// compiles it and caches its bytecode, and returns the status of the load.
+func (c *ChunkCache) load(l *LuaState, src []byte, name, mode string) int {
+	key := c.key(src, name)
+	if bc, ok := c.get(key); ok {
+		if l.loadBuffer(bc, name, "b") == LUA_OK {
+			return LUA_OK
+		}
+		// Bytecode of another build of Lua, compile it again
+		l.Pop(1)
+	}
+	if status := l.loadBuffer(src, name, mode); status != LUA_OK {
+		return status
+	}
+	var bc bytes.Buffer
+	if l.Dump(&bc, false) == nil {
+		// Only files go to the directory, strings loaded by a program
+		// could fill it without bound
+		c.put(key, bc.Bytes(), strings.HasPrefix(name, "@"))
+	}
+	return LUA_OK
+}
+
+// readChunkFile reads the file loaded by loadFileX, dropping a UTF-8 BOM and
+// a first line starting with '#' like luaL_loadfilex does.
+func readChunkFile(path string) ([]byte, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	src = bytes.TrimPrefix(src, []byte("\xEF\xBB\xBF"))
+	if len(src) > 0 && src[0] == '#' {
+		// Keep the newline so that line numbers do not change
+		if i := bytes.IndexByte(src, '\n'); i >= 0 {
+			src = src[i:]
+		} else {
+			src = nil
+		}
+		// but not in front of a binary chunk
+		if len(src) > 1 && src[1] == LUA_SIGNATURE[0] {
+			src = src[1:]
+		}
+	}
+	return src, nil
+}
@@ -0,0 +1,107 @@
+package lua
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestChunkCache(t *testing.T) {
+	c, err := NewChunkCache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	L := NewLuaState(WithChunkCache(c))
+	defer L.Close()
+	for i := 0; i < 2; i++ {
+		if err := L.DoStringErr(`n = (n or 0) + 1`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	L.GetGlobal("n")
+	if n := L.ToInteger(-1); n != 2 || len(c.chunks) != 1 {
+		t.Errorf("n = %d with %d chunks cached, want 2 with 1", n, len(c.chunks))
+	}
+	L.Pop(1)
+	// Binary chunks are not cached
+	L.LoadString(`return 1`)
+	var bc bytes.Buffer
+	if err := L.Dump(&bc, false); err != nil {
+		t.Fatal(err)
+	}
+	L.Pop(1)
+	if !L.LoadBuffer(bc.Bytes(), "=bin") || len(c.chunks) != 2 {
+		t.Errorf("%d chunks cached after loading bytecode, want 2", len(c.chunks))
+	}
+	L.Pop(1)
+}
+
+func TestChunkCacheSize(t *testing.T) {
+	c, _ := NewChunkCache("")
+	L := NewLuaState(WithChunkCache(c))
+	defer L.Close()
+	for i := 0; i < 1000; i++ {
+		L.LoadString(`return ` + string(rune('a'+i%26)) + ` or ` + strconv.Itoa(i))
+		L.Pop(1)
+	}
+	if c.size > DefaultChunkCacheSize || len(c.chunks) != 1000 {
+		t.Errorf("%d chunks in %d bytes", len(c.chunks), c.size)
+	}
+	c.SetMaxSize(c.size / 2)
+	if c.size > c.maxSize || len(c.chunks) >= 1000 || len(c.chunks) != c.lru.Len() {
+		t.Errorf("%d chunks in %d bytes after shrinking to %d", len(c.chunks), c.size, c.maxSize)
+	}
+	// The most recent chunk is kept
+	if _, ok := c.get(c.key([]byte(`return l or 999`), `return l or 999`)); !ok {
+		t.Error("most recent chunk dropped")
+	}
+	c.SetMaxSize(0)
+	if len(c.chunks) != 0 || c.size != 0 {
+		t.Errorf("%d chunks in %d bytes left", len(c.chunks), c.size)
+	}
+}
+
+func TestChunkCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewChunkCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "script.lua")
+	if err := ioutil.WriteFile(path, []byte("#!/usr/bin/lua\nreturn 40 + 2"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	L := NewLuaState(WithChunkCache(c))
+	defer L.Close()
+	if err := L.DoStringErr(`x = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if !L.LoadFile(path) {
+		t.Fatal("LoadFile failed")
+	}
+	L.Pop(1)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.luac"))
+	if len(files) != 1 {
+		t.Fatalf("%d chunks in the directory, want only the file", len(files))
+	}
+	// Another cache on the directory loads the stored bytecode, and compiles
+	// the source again when it is not valid
+	if err := ioutil.WriteFile(files[0], []byte(LUA_SIGNATURE+"garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c2, _ := NewChunkCache(dir)
+	L2 := NewLuaState(WithChunkCache(c2))
+	defer L2.Close()
+	if !L2.LoadFile(path) {
+		t.Fatal("LoadFile with invalid bytecode failed")
+	}
+	if err := L2.PCallErr(0, 1, 0); err != nil || L2.ToInteger(-1) != 42 {
+		t.Errorf("got %d, %v", L2.ToInteger(-1), err)
+	}
+	if _, err := os.Stat(files[0]); err != nil {
+		t.Error(err)
+	}
+}
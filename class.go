@@ -0,0 +1,209 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Class describes a Go type for Lua: how scripts construct it and what its
+// objects offer on top of the fields and methods PushObject exposes. A Class
+// does not depend on a state, build it once and register it in every state
+// with RegisterClass:
+//
+//	vec := lua.NewClass("Vec", (*Vec)(nil)).
+//		Constructor(func(x, y float64) *Vec { return &Vec{x, y} }).
+//		Property("length", (*Vec).Length, nil).
+//		Meta("__add", func(a, b *Vec) *Vec { return &Vec{a.X + b.X, a.Y + b.Y} })
+//	L.RegisterClass(vec)
+//	L.DoString(`local v = Vec(3, 4) + Vec.new(1, 1) print(v.length)`)
+//
+// Functions given to a Class convert their arguments and results like
+// PushGoFunc, and results of the type of a registered class are pushed as
+// objects. The builder methods panic when given a function that does not
+// fit, as these are programming errors.
+type Class struct {
+	name    string
+	typ     reflect.Type
+	ctor    reflect.Value
+	methods []classFunc
+	statics []classFunc
+	metas   []classFunc
+	props   map[string]property
+}
+
+type classFunc struct {
+	name string
+	fn   reflect.Value
+}
+
+// property is a field of a class computed by Go functions, get or set is
+// invalid when missing.
+type property struct {
+	get reflect.Value
+	set reflect.Value
+}
+
+// Metamethods that Meta refuses, PushObject sets them
+var reservedMetas = map[string]bool{
+	"__index": true, "__newindex": true, "__gc": true, "__name": true, "__metatable": true,
+}
+
+// NewClass starts the description of the type ptr points to, for example
+// NewClass("Vec", (*Vec)(nil)). name is the global holding the class in Lua.
+func NewClass(name string, ptr any) *Class {
+	t := reflect.TypeOf(ptr)
+	if t == nil || t.Kind() != reflect.Pointer {
+		panic(fmt.Sprintf("lua: NewClass needs a pointer type, not %T", ptr))
+	}
+	return &Class{name: name, typ: t, props: make(map[string]property)}
+}
+
+// checkFunc panics unless fn is a function with at least in parameters, the
+// first of which is the pointer type of c when self is set.
+func (c *Class) checkFunc(what string, fn any, self bool) reflect.Value {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		panic(fmt.Sprintf("lua: %s of %s needs a function, not %T", what, c.name, fn))
+	}
+	if self && (v.Type().NumIn() == 0 || v.Type().In(0) != c.typ) {
+		panic(fmt.Sprintf("lua: %s of %s needs a function taking %s first, not %T", what, c.name, c.typ, fn))
+	}
+	return v
+}
+
+// Constructor sets the function creating the objects of the class, called
+// from Lua as Name(...) or Name.new(...). It returns a pointer of the type
+// of the class, and possibly an error.
+func (c *Class) Constructor(fn any) *Class {
+	v := c.checkFunc("Constructor", fn, false)
+	if v.Type().NumOut() == 0 || v.Type().Out(0) != c.typ {
+		panic(fmt.Sprintf("lua: Constructor of %s needs a function returning %s, not %T", c.name, c.typ, fn))
+	}
+	c.ctor = v
+	return c
+}
+
+// Method adds a method called as obj:name(...), fn takes the object first.
+// Methods of the Go type need not be added, they are there already. Methods
+// are kept in the metatable, so name cannot start with "__", use Meta for
+// metamethods.
+func (c *Class) Method(name string, fn any) *Class {
+	if strings.HasPrefix(name, "__") {
+		panic(fmt.Sprintf("lua: Method of %s cannot be named %s", c.name, name))
+	}
+	c.methods = append(c.methods, classFunc{name, c.checkFunc("Method "+name, fn, true)})
+	return c
+}
+
+// Static adds a function called as Name.name(...) that takes no object.
+func (c *Class) Static(name string, fn any) *Class {
+	c.statics = append(c.statics, classFunc{name, c.checkFunc("Static "+name, fn, false)})
+	return c
+}
+
+// Property adds a field of the objects read with get, a func(*T) V, and
+// assigned with set, a func(*T, V). Either may be nil for a read-only or a
+// write-only property. Properties hide the fields of the same name.
+func (c *Class) Property(name string, get, set any) *Class {
+	var p property
+	if get != nil {
+		p.get = c.checkFunc("Property "+name, get, true)
+	}
+	if set != nil {
+		p.set = c.checkFunc("Property "+name, set, true)
+	}
+	c.props[name] = p
+	return c
+}
+
+// Meta sets the metamethod event, such as "__tostring", "__eq", "__lt",
+// "__le", "__len", "__call", "__close" or "__add", to fn. Its arguments are
+// the operands Lua passes, so fn takes the object first except for binary
+// operators where the object may be either operand. "__eq" is only called
+// when both operands are objects of the class. "__index", "__newindex",
+// "__gc", "__name" and "__metatable" cannot be set.
+func (c *Class) Meta(event string, fn any) *Class {
+	if reservedMetas[event] {
+		panic(fmt.Sprintf("lua: Meta of %s cannot set %s", c.name, event))
+	}
+	c.metas = append(c.metas, classFunc{event, c.checkFunc("Meta "+event, fn, false)})
+	return c
+}
+
+// RegisterClass adds the methods, properties and metamethods of c to the
+// metatable of its objects, once per state, and sets the global named after
+// c to the class table holding the static functions and new, which is also
+// called by calling the table. It fails when another class was registered
+// for the same type.
+func (l *LuaState) RegisterClass(c *Class) error {
+	ot := l.pushObjectMeta(c.typ)
+	switch ot.class {
+	case c:
+		l.Pop(1)
+		l.setClassTable(c)
+		return nil
+	case nil:
+	default:
+		l.Pop(1)
+		return fmt.Errorf("lua: %s is already registered as class %s", c.typ, ot.class.name)
+	}
+	ot.class = c
+	for _, m := range c.methods {
+		ot.methods[m.name] = true
+		l.pushMethod(c.typ, m.fn)
+		l.SetField(-2, m.name)
+	}
+	for name, p := range c.props {
+		ot.props[name] = p
+	}
+	for _, m := range c.metas {
+		if m.name == "__eq" {
+			l.pushEq(c.typ, m.fn)
+		} else {
+			l.PushGoFunc(m.fn.Interface())
+		}
+		l.SetField(-2, m.name)
+	}
+	l.Pop(1)
+	l.setClassTable(c)
+	return nil
+}
+
+// pushEq pushes the __eq metamethod calling fn, false for operands that are
+// not both objects of the pointer type t.
+func (l *LuaState) pushEq(t reflect.Type, fn reflect.Value) {
+	l.PushFunction(func(L *LuaState) int {
+		a, aok := L.toObject(1)
+		b, bok := L.toObject(2)
+		if !aok || !bok || a.Type() != t || b.Type() != t {
+			L.PushBoolean(false)
+			return 1
+		}
+		return L.callGoFunc(fn, []reflect.Value{a, b}, 3)
+	})
+}
+
+// setClassTable sets the global of c to its class table.
+func (l *LuaState) setClassTable(c *Class) {
+	l.CreateTable(0, len(c.statics)+1)
+	for _, s := range c.statics {
+		l.PushGoFunc(s.fn.Interface())
+		l.SetField(-2, s.name)
+	}
+	if c.ctor.IsValid() {
+		ctor := c.ctor
+		l.PushFunction(func(L *LuaState) int {
+			return L.callGoFunc(ctor, nil, 1)
+		})
+		l.SetField(-2, "new")
+		// Calling the class passes it first
+		l.CreateTable(0, 1)
+		l.PushFunction(func(L *LuaState) int {
+			return L.callGoFunc(ctor, nil, 2)
+		})
+		l.SetField(-2, "__call")
+		l.SetMetaTable(-2)
+	}
+	l.SetGlobal(c.name)
+}
@@ -0,0 +1,104 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+type vec struct {
+	X, Y float64
+}
+
+func (v *vec) Length() float64 {
+	return math.Hypot(v.X, v.Y)
+}
+
+var vecClass = NewClass("Vec", (*vec)(nil)).
+	Constructor(func(x, y float64) (*vec, error) {
+		if math.IsNaN(x) || math.IsNaN(y) {
+			return nil, errors.New("NaN coordinate")
+		}
+		return &vec{x, y}, nil
+	}).
+	Method("scale", func(v *vec, k float64) *vec { return &vec{v.X * k, v.Y * k} }).
+	Static("zero", func() *vec { return &vec{} }).
+	Property("length", (*vec).Length, func(v *vec, n float64) {
+		k := n / v.Length()
+		v.X, v.Y = v.X*k, v.Y*k
+	}).
+	Property("secret", nil, func(v *vec, s string) {}).
+	Meta("__add", func(a, b *vec) *vec { return &vec{a.X + b.X, a.Y + b.Y} }).
+	Meta("__eq", func(a, b *vec) bool { return *a == *b }).
+	Meta("__tostring", func(v *vec) string { return fmt.Sprintf("(%g, %g)", v.X, v.Y) })
+
+func TestRegisterClass(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	if err := L.RegisterClass(vecClass); err != nil {
+		t.Fatal(err)
+	}
+	// Registering it again is harmless
+	if err := L.RegisterClass(vecClass); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoStringErr(`
+		local v = Vec(3, 4)
+		assert(v.length == 5 and v:Length() == 5 and v.X == 3)
+		assert(tostring(Vec.new(1, 2)) == "(1, 2)")
+		assert(v + Vec(1, 1) == Vec(4, 5) and v ~= Vec(0, 0) and v ~= 1)
+		assert(v:scale(2).Y == 8 and Vec.zero().X == 0)
+		v.length = 10
+		assert(v.X == 6 and v.Y == 8)
+		v.secret = "x"`); err != nil {
+		t.Fatal(err)
+	}
+	var v *vec
+	L.DoStringErr(`v = Vec(1, 0)`)
+	L.GetGlobal("v")
+	if err := L.To(-1, &v); err != nil || *v != (vec{1, 0}) {
+		t.Errorf("To = %v, %v", v, err)
+	}
+	L.Pop(1)
+	for _, c := range []struct{ src, msg string }{
+		{`Vec(0/0, 1)`, "NaN coordinate"},
+		{`Vec.new("x", 1)`, "bad argument #1 to 'new' (number expected, got string)"},
+		{`return Vec(1, 1).secret`, "property 'secret' of *lua.vec is write-only"},
+		{`Vec(1, 1).Length = 2`, "no field 'Length'"},
+	} {
+		if err := L.DoStringErr(c.src); err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%s: got %v, want %q", c.src, err, c.msg)
+		}
+	}
+	// Another class for the same type is refused
+	if err := L.RegisterClass(NewClass("Vec2", (*vec)(nil))); err == nil {
+		t.Error("second class of vec registered")
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("stack has %d values, want 0", L.GetTop())
+	}
+}
+
+func TestClassBuilderPanics(t *testing.T) {
+	for name, build := range map[string]func(){
+		"non pointer":    func() { NewClass("V", vec{}) },
+		"constructor":    func() { NewClass("V", (*vec)(nil)).Constructor(func() vec { return vec{} }) },
+		"method":         func() { NewClass("V", (*vec)(nil)).Method("m", func(v vec) {}) },
+		"reserved":       func() { NewClass("V", (*vec)(nil)).Meta("__index", func(v *vec) {}) },
+		"method __gc":    func() { NewClass("V", (*vec)(nil)).Method("__gc", func(v *vec) {}) },
+		"method __index": func() { NewClass("V", (*vec)(nil)).Method("__index", func(v *vec) {}) },
+		"method __add":   func() { NewClass("V", (*vec)(nil)).Method("__add", func(v *vec) {}) },
+		"not a func":     func() { NewClass("V", (*vec)(nil)).Static("s", 1) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s did not panic", name)
+				}
+			}()
+			build()
+		}()
+	}
+}
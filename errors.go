@@ -0,0 +1,155 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Sentinel errors matching the Lua status codes, use them with errors.Is to
+// branch on the kind of failure reported by a *LuaError.
+var (
+	ErrRun    = errors.New("lua: runtime error")
+	ErrSyntax = errors.New("lua: syntax error")
+	ErrMem    = errors.New("lua: memory allocation error")
+	ErrErr    = errors.New("lua: error while running the message handler")
+	ErrFile   = errors.New("lua: cannot open or read file")
+)
+
+// ErrFuelExhausted is the cause of the error raised when a script runs out of
+// the instructions allowed by SetFuel or PCallFuel.
+var ErrFuelExhausted = errors.New("lua: instruction budget exhausted")
+
+// LuaError is the error returned when loading or running a chunk fails.
+type LuaError struct {
+	// Status is one of LUA_ERRRUN, LUA_ERRSYNTAX, LUA_ERRMEM, LUA_ERRERR or
+	// LUA_ERRFILE.
+	Status int
+	// Source is the chunk the error position points at, for example
+	// `[string "x = ("]` or `main.lua`. It is empty when the message has no
+	// position information.
+	Source string
+	// Line is the line the error was raised on, 0 when unknown.
+	Line int
+	// Message is the error message without the traceback.
+	Message string
+	// Value is the original error value converted to Go: nil, bool, int64,
+	// float64 or string, the message for errors raised by Go functions.
+	// Other Lua types are described as "type: address".
+	Value any
+	// Traceback is the stack traceback appended by the message handler used
+	// in CallSafeErr, empty for calls made without one.
+	Traceback string
+	// Cause is the Go error passed to RaiseError when the error value was
+	// raised by a Go function.
+	Cause error
+}
+
+func (e *LuaError) Error() string {
+	return e.Message
+}
+
+func (e *LuaError) Unwrap() error {
+	return e.Cause
+}
+
+// Is reports whether target is the sentinel error for the status of e.
+func (e *LuaError) Is(target error) bool {
+	return target != nil && statusError(e.Status) == target
+}
+
+func statusError(status int) error {
+	switch status {
+	case LUA_ERRRUN:
+		return ErrRun
+	case LUA_ERRSYNTAX:
+		return ErrSyntax
+	case LUA_ERRMEM:
+		return ErrMem
+	case LUA_ERRERR:
+		return ErrErr
+	case LUA_ERRFILE:
+		return ErrFile
+	default:
+		return nil
+	}
+}
+
+// PanicError is the Lua error raised when a Go function called by Lua panics.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value any
+	// Stack is the Go stack of the panicking goroutine.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("go panic: %v", e.Value)
+}
+
+const tracebackHeader = "\nstack traceback:\n"
+
+var errorPosition = regexp.MustCompile(`^(\[string ".*?"\]|[^:\n]+):(\d+): `)
+
+// popError builds a *LuaError from the error value on top of the stack and
+// pops it.
+func (l *LuaState) popError(status int) *LuaError {
+	err := &LuaError{
+		Status: status,
+		Value:  l.errorValue(-1),
+	}
+	e, isGo := l.goError(-1)
+	if isGo {
+		err.Cause = e.err
+	}
+	switch {
+	case l.Type(-1) == LUA_TSTRING || isGo:
+		msg := err.Value.(string)
+		if i := strings.Index(msg, tracebackHeader); i >= 0 {
+			err.Traceback = msg[i+1:]
+			msg = msg[:i]
+			err.Value = msg
+		}
+		err.Message = msg
+	case l.Type(-1) == LUA_TNUMBER:
+		// Lua turns number errors into strings, convert a copy
+		l.PushValue(-1)
+		err.Message = l.ToString(-1)
+		l.Pop(1)
+	default:
+		err.Message = fmt.Sprintf("(error object is a %s value)", l.TypeName(l.Type(-1)))
+	}
+	if m := errorPosition.FindStringSubmatch(err.Message); m != nil {
+		err.Source = m[1]
+		err.Line, _ = strconv.Atoi(m[2])
+	}
+	l.Pop(1)
+	return err
+}
+
+// errorValue converts the error value at idx to Go without calling any
+// metamethods, so it is safe to use from within a message handler.
+func (l *LuaState) errorValue(idx int) any {
+	switch l.Type(idx) {
+	case LUA_TNIL, LUA_TNONE:
+		return nil
+	case LUA_TBOOLEAN:
+		return l.ToBoolean(idx)
+	case LUA_TNUMBER:
+		if l.IsInteger(idx) {
+			return l.ToInteger(idx)
+		}
+		return l.ToNumber(idx)
+	case LUA_TSTRING:
+		return l.ToString(idx)
+	case LUA_TUSERDATA:
+		if e, ok := l.goError(idx); ok {
+			return e.msg
+		}
+		fallthrough
+	default:
+		return fmt.Sprintf("%s: %p", l.TypeName(l.Type(idx)), l.ToPointer(idx))
+	}
+}
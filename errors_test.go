@@ -0,0 +1,210 @@
+package lua
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var errBoom = errors.New("boom")
+
+func newBoomState(t *testing.T) *LuaState {
+	t.Helper()
+	L := NewLuaState()
+	t.Cleanup(L.Close)
+	L.SetGlobalFunction("boom", func(L *LuaState) int {
+		return L.RaiseError(errBoom)
+	})
+	return L
+}
+
+func TestRaiseError(t *testing.T) {
+	L := newBoomState(t)
+	err := L.DoStringErr("local x = 1\nboom()")
+	var le *LuaError
+	if !errors.As(err, &le) {
+		t.Fatalf("got %v, want a *LuaError", err)
+	}
+	if !errors.Is(err, errBoom) || !errors.Is(err, ErrRun) {
+		t.Errorf("%v does not unwrap to boom and ErrRun", err)
+	}
+	if le.Message != `[string "local x = 1..."]:2: boom` || le.Line != 2 {
+		t.Errorf("Message = %q, Line = %d", le.Message, le.Line)
+	}
+	if le.Value != le.Message {
+		t.Errorf("Value = %#v, want the message", le.Value)
+	}
+}
+
+func TestRaiseErrorCaught(t *testing.T) {
+	L := newBoomState(t)
+	// The script sees the message through tostring
+	if err := L.DoStringErr(`
+		local ok, e = pcall(boom)
+		assert(not ok and tostring(e):find("boom$"), tostring(e))
+		error("x.lua:1: bad", 0)`); err == nil || errors.Is(err, errBoom) {
+		t.Errorf("error after a caught Go error = %v, want no cause", err)
+	}
+	// Raising the caught value again keeps its cause
+	if err := L.DoStringErr(`local _, e = pcall(boom) error(e)`); !errors.Is(err, errBoom) {
+		t.Errorf("rethrown Go error = %v, want boom", err)
+	}
+	// coroutine.wrap passes the value through
+	if err := L.DoStringErr(`coroutine.wrap(boom)()`); !errors.Is(err, errBoom) {
+		t.Errorf("Go error through coroutine.wrap = %v, want boom", err)
+	}
+	L.GCCollect()
+	if n := len(L.raised); n != 0 {
+		t.Errorf("%d raised errors left after collection", n)
+	}
+}
+
+func TestErrorGCCalledByScript(t *testing.T) {
+	L := newBoomState(t)
+	if err := L.DoStringErr(`
+		local _, e = pcall(boom)
+		local gc = debug.getmetatable(e).__gc
+		gc(1) gc({}) gc(io.stdout) gc()
+		assert(tostring(e):find("boom$"))`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCallSafeErrCause(t *testing.T) {
+	L := newBoomState(t)
+	L.GetGlobal("boom")
+	err := L.CallSafeErr(0, 0)
+	var le *LuaError
+	if !errors.As(err, &le) || !errors.Is(err, errBoom) {
+		t.Fatalf("got %v, want a *LuaError for boom", err)
+	}
+	if !strings.HasSuffix(le.Message, "boom") || le.Traceback == "" {
+		t.Errorf("Message = %q, Traceback = %q", le.Message, le.Traceback)
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("stack has %d values, want 0", L.GetTop())
+	}
+}
+
+func TestLuaErrorStatus(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	err := L.DoStringErr("x = (")
+	var le *LuaError
+	if !errors.As(err, &le) || !errors.Is(err, ErrSyntax) || le.Status != LUA_ERRSYNTAX {
+		t.Fatalf("got %v, want a syntax error", err)
+	}
+	err = L.DoStringErr("error(42)")
+	if !errors.As(err, &le) || le.Value != int64(42) || le.Message != "42" {
+		t.Errorf("got %#v, want the value 42", le)
+	}
+	// CallSafeErr reports the same message
+	L.LoadString("error(42)")
+	if err := L.CallSafeErr(0, 0); !errors.As(err, &le) || le.Message != "42" {
+		t.Errorf("CallSafeErr got %#v, want the message 42", err)
+	}
+	if err := L.DoStringErr("error(1.5)"); !errors.As(err, &le) || le.Message != "1.5" || le.Value != 1.5 {
+		t.Errorf("got %#v, want the value 1.5", le)
+	}
+	if err := L.DoStringErr("error({})"); !errors.As(err, &le) || le.Message != "(error object is a table value)" {
+		t.Errorf("got %#v, want a table described", le)
+	}
+}
+
+func TestLuaErrorPosition(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	path := filepath.Join(t.TempDir(), "main.lua")
+	if err := os.WriteFile(path, []byte("local x = 1\n\nerror('bad')\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		err    error
+		source string
+		line   int
+	}{
+		{L.DoStringErr("x = ("), `[string "x = ("]`, 1},
+		{L.DoStringErr("local a = 1\nlocal b = nil + a"), `[string "local a = 1..."]`, 2},
+		{L.DoFileErr(path), path, 3},
+		{L.DoStringErr(`error("no position", 0)`), "", 0},
+		{L.DoStringErr(`error("x.lua:12: not a chunk of ours", 0)`), "x.lua", 12},
+	} {
+		var le *LuaError
+		if !errors.As(c.err, &le) || le.Source != c.source || le.Line != c.line {
+			t.Errorf("%v: got source %q, line %d, want %q, %d", c.err, le.Source, le.Line, c.source, c.line)
+		}
+	}
+	if !L.LoadBuffer([]byte("\n\nerror('named')"), "=named") {
+		t.Fatal("load failed")
+	}
+	var le *LuaError
+	if err := L.PCallErr(0, 0, 0); !errors.As(err, &le) || le.Source != "named" || le.Line != 3 || le.Message != "named:3: named" {
+		t.Errorf("got %#v", err)
+	}
+}
+
+func TestCallSafeErrValue(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	if !L.LoadBuffer([]byte(`error(setmetatable({}, {__tostring = function() return "custom" end}))`), "=t") {
+		t.Fatal("load failed")
+	}
+	err := L.CallSafeErr(0, 0)
+	var le *LuaError
+	if !errors.As(err, &le) || le.Message != "custom" {
+		t.Fatalf("got %#v, want the message of __tostring", err)
+	}
+	if !L.LoadBuffer([]byte(`error(true)`), "=t") {
+		t.Fatal("load failed")
+	}
+	err = L.CallSafeErr(0, 0)
+	if !errors.As(err, &le) || le.Value != true || !strings.HasPrefix(le.Message, "(error object is a boolean value)") {
+		t.Errorf("got %#v, want the value true", err)
+	}
+}
+
+func TestPanicRecovered(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.SetGlobalFunction("crash", func(L *LuaState) int {
+		panic("oops")
+	})
+	err := L.DoStringErr(`crash()`)
+	var pe *PanicError
+	if !errors.As(err, &pe) || pe.Value != "oops" || len(pe.Stack) == 0 {
+		t.Fatalf("got %v, want a *PanicError for oops", err)
+	}
+	// Scripts catch it like any error and the state keeps working
+	if err := L.DoStringErr(`
+		local ok, e = pcall(crash)
+		assert(not ok and tostring(e):find("go panic: oops", 1, true), tostring(e))`); err != nil {
+		t.Error(err)
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("stack has %d values, want 0", L.GetTop())
+	}
+}
+
+func TestRepanic(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.SetGlobalFunction("crash", func(L *LuaState) int {
+		panic(errBoom)
+	})
+	L.SetRepanic(true)
+	defer func() {
+		pe, ok := recover().(*PanicError)
+		if !ok || pe.Value != errBoom {
+			t.Errorf("recovered %v, want a *PanicError for boom", pe)
+		}
+		// Panicking again left nothing behind
+		L.SetRepanic(false)
+		if err := L.DoStringErr(`assert(pcall(print))`); err != nil {
+			t.Error(err)
+		}
+	}()
+	L.DoStringErr(`pcall(crash)`)
+	t.Error("the panic caught by pcall was not raised again")
+}
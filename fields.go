@@ -0,0 +1,234 @@
+package lua
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// FieldNaming is the strategy naming the table fields of the struct fields
+// without a name in their lua tag.
+type FieldNaming int
+
+const (
+	// NamingAsIs uses the Go field name, "UserID" stays "UserID".
+	NamingAsIs FieldNaming = iota
+	// NamingLowerCamel lowers the leading capitals, "UserID" becomes
+	// "userID" and "HTTPServer" "httpServer".
+	NamingLowerCamel
+	// NamingSnakeCase splits the words with underscores, "UserID" becomes
+	// "user_id" and "HTTPServer" "http_server".
+	NamingSnakeCase
+)
+
+// WithFieldNaming sets the naming strategy of the state, see SetFieldNaming.
+func WithFieldNaming(n FieldNaming) Option {
+	return func(L *LuaState) {
+		L.SetFieldNaming(n)
+	}
+}
+
+// SetFieldNaming sets the strategy naming the table fields of struct fields
+// for Push and To. It applies to the fields whose lua tag gives no name:
+//
+//	Name  string `lua:"name"`           // field "name"
+//	Note  string `lua:",omitempty"`     // named by n, left out when empty
+//	Extra Extra  `lua:",inline"`        // fields of Extra in the same table
+//	Cache []byte `lua:"-"`              // never converted
+//
+// Like encoding/json, the exported fields of embedded structs are inlined
+// unless the tag names the embedded field, and of several fields with the
+// same name the least nested wins, then the one named by its tag, and the
+// others are left out.
+func (l *LuaState) SetFieldNaming(n FieldNaming) {
+	l.fieldNaming = n
+}
+
+// name returns the table field name of the Go field name s.
+func (n FieldNaming) name(s string) string {
+	switch n {
+	case NamingLowerCamel:
+		r := []rune(s)
+		i := 0
+		for i < len(r) && unicode.IsUpper(r[i]) {
+			i++
+		}
+		// Keep the capital starting the next word, "HTTPServer"
+		if i > 1 && i < len(r) && unicode.IsLower(r[i]) {
+			i--
+		}
+		for j := 0; j < i; j++ {
+			r[j] = unicode.ToLower(r[j])
+		}
+		return string(r)
+	case NamingSnakeCase:
+		r := []rune(s)
+		var b strings.Builder
+		for i, c := range r {
+			if i > 0 && unicode.IsUpper(c) {
+				prev := r[i-1]
+				nextLower := i+1 < len(r) && unicode.IsLower(r[i+1])
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) || unicode.IsUpper(prev) && nextLower {
+					b.WriteByte('_')
+				}
+			}
+			b.WriteRune(unicode.ToLower(c))
+		}
+		return b.String()
+	default:
+		return s
+	}
+}
+
+// field is a struct field converted to and from a table field.
+type field struct {
+	name      string
+	index     []int
+	tagged    bool
+	omitEmpty bool
+}
+
+type fieldKey struct {
+	t      reflect.Type
+	naming FieldNaming
+}
+
+var fieldCache sync.Map // map[fieldKey][]field
+
+// typeFields returns the fields of the struct type t converted to and from
+// table fields, following the rules of SetFieldNaming.
+func typeFields(t reflect.Type, naming FieldNaming) []field {
+	key := fieldKey{t, naming}
+	if fs, ok := fieldCache.Load(key); ok {
+		return fs.([]field)
+	}
+	var all []field
+	collectFields(t, naming, nil, map[reflect.Type]bool{}, &all)
+	// The least nested field of a name wins, then the tagged one
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].name != all[j].name {
+			return all[i].name < all[j].name
+		}
+		if len(all[i].index) != len(all[j].index) {
+			return len(all[i].index) < len(all[j].index)
+		}
+		return all[i].tagged && !all[j].tagged
+	})
+	var fields []field
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && all[j].name == all[i].name {
+			j++
+		}
+		first := all[i]
+		if j == i+1 || len(all[i+1].index) > len(first.index) || first.tagged && !all[i+1].tagged {
+			fields = append(fields, first)
+		}
+		i = j
+	}
+	// Convert the fields in the order of the struct
+	sort.Slice(fields, func(i, j int) bool {
+		a, b := fields[i].index, fields[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	fs, _ := fieldCache.LoadOrStore(key, fields)
+	return fs.([]field)
+}
+
+// collectFields appends the fields of t to all, inlining the embedded and
+// inline struct fields. seen holds the structs being inlined, to stop at
+// recursive embedding.
+func collectFields(t reflect.Type, naming FieldNaming, index []int, seen map[reflect.Type]bool, all *[]field) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	defer delete(seen, t)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("lua")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		ft := sf.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		// Unexported embedded structs still promote their exported fields
+		if !sf.IsExported() && !(sf.Anonymous && ft.Kind() == reflect.Struct) {
+			continue
+		}
+		idx := append(append([]int(nil), index...), i)
+		inline := ft.Kind() == reflect.Struct && name == "" && (sf.Anonymous || hasOption(opts, "inline"))
+		if inline {
+			collectFields(ft, naming, idx, seen, all)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		f := field{name: name, index: idx, tagged: name != "", omitEmpty: hasOption(opts, "omitempty")}
+		if f.name == "" {
+			f.name = naming.name(sf.Name)
+		}
+		*all = append(*all, f)
+	}
+}
+
+func hasOption(opts, name string) bool {
+	for opts != "" {
+		var o string
+		o, opts, _ = strings.Cut(opts, ",")
+		if o == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldByIndex is v.FieldByIndex through embedded pointers, which are
+// allocated when nil if alloc is set. It returns false for a field behind a
+// nil pointer that was not allocated.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// isEmptyValue reports whether v is left out by omitempty, the same values
+// as encoding/json.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
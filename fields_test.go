@@ -0,0 +1,85 @@
+package lua
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFieldNaming(t *testing.T) {
+	for _, c := range []struct {
+		naming   FieldNaming
+		in, want string
+	}{
+		{NamingAsIs, "UserID", "UserID"},
+		{NamingLowerCamel, "UserID", "userID"},
+		{NamingLowerCamel, "HTTPServer", "httpServer"},
+		{NamingLowerCamel, "ID", "id"},
+		{NamingSnakeCase, "UserID", "user_id"},
+		{NamingSnakeCase, "HTTPServer", "http_server"},
+		{NamingSnakeCase, "Port8080Open", "port8080_open"},
+	} {
+		if got := c.naming.name(c.in); got != c.want {
+			t.Errorf("naming %d of %q = %q, want %q", c.naming, c.in, got, c.want)
+		}
+	}
+}
+
+type Base struct {
+	ID   int
+	Kind string
+}
+
+type extra struct {
+	Color string
+}
+
+type tagged struct {
+	Base
+	Kind      string            // shadows Base.Kind
+	UserName  string            `lua:"login"`
+	Note      string            `lua:",omitempty"`
+	Extra     extra             `lua:",inline"`
+	Cache     []byte            `lua:"-"`
+	Labels    map[string]string `lua:"labels,omitempty"`
+	MaxRetry  int
+	Unchanged string
+}
+
+func TestStructTags(t *testing.T) {
+	L := NewLuaState(WithFieldNaming(NamingSnakeCase))
+	defer L.Close()
+	in := tagged{
+		Base:      Base{ID: 1, Kind: "base"},
+		Kind:      "outer",
+		UserName:  "ann",
+		Extra:     extra{Color: "red"},
+		Cache:     []byte("secret"),
+		MaxRetry:  3,
+		Unchanged: "kept",
+	}
+	if err := L.Push(in); err != nil {
+		t.Fatal(err)
+	}
+	L.SetGlobal("v")
+	if err := L.DoStringErr(`
+		assert(v.id == 1 and v.kind == "outer" and v.login == "ann", "names")
+		assert(v.note == nil and v.labels == nil, "omitempty")
+		assert(v.color == "red" and v.extra == nil, "inline")
+		assert(v.cache == nil and v.Cache == nil, "skipped")
+		assert(v.max_retry == 3, "snake case")
+		v.note, v.color, v.max_retry, v.unchanged = "hi", "blue", 5, nil`); err != nil {
+		t.Fatal(err)
+	}
+	L.GetGlobal("v")
+	out := tagged{Cache: []byte("mine"), Unchanged: "kept"}
+	if err := L.To(-1, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := in
+	want.Note, want.Extra.Color, want.MaxRetry, want.Cache = "hi", "blue", 5, []byte("mine")
+	// The shadowed field has no table field, nil leaves the Go field as is
+	want.Base.Kind = ""
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("got %+v, want %+v", out, want)
+	}
+}
@@ -0,0 +1,227 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ArgError is the error raised by a function pushed with PushGoFunc for an
+// argument that does not convert to its parameter. Its message is the one of
+// luaL_argerror.
+type ArgError struct {
+	// Arg is the position of the argument, not counting self for methods,
+	// 0 for self.
+	Arg int
+	// Func is the name of the function as called by Lua, "?" if unknown.
+	Func string
+	// Message describes the problem, "number expected, got string", ...
+	Message string
+	// Err is the conversion error, a *TypeError or *CycleError, or nil.
+	Err error
+}
+
+func (e *ArgError) Error() string {
+	if e.Arg == 0 {
+		return fmt.Sprintf("calling '%s' on bad self (%s)", e.Func, e.Message)
+	}
+	return fmt.Sprintf("bad argument #%d to '%s' (%s)", e.Arg, e.Func, e.Message)
+}
+
+func (e *ArgError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	luaStateType = reflect.TypeOf((*LuaState)(nil))
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// RegisterGoFunc sets the global name to fn, see PushGoFunc.
+func (l *LuaState) RegisterGoFunc(name string, fn any) {
+	l.PushGoFunc(fn)
+	l.SetGlobal(name)
+}
+
+// PushGoFunc pushes any Go function fn as a Lua function. The arguments are
+// converted to the parameters of fn with To, the arguments left over go to
+// the variadic parameter if any, and the results are pushed with Push. A
+// first parameter of type *LuaState receives the calling state and takes no
+// argument. When the last result is an error, it is not pushed and a non nil
+// error is raised, a *LuaError caught on the Go side unwraps to it.
+//
+// A nil or missing argument is an error unless its parameter is a pointer,
+// an interface, a slice or a map. Arguments that do not convert raise an
+// *ArgError worded like luaL_argerror, "bad argument #1 to 'f' (number
+// expected, got string)". PushGoFunc panics if fn is not a function.
+func (l *LuaState) PushGoFunc(fn any) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || v.IsNil() {
+		panic(fmt.Sprintf("lua: PushGoFunc needs a function, not %T", fn))
+	}
+	withState := t.NumIn() > 0 && t.In(0) == luaStateType
+	l.PushFunction(func(L *LuaState) int {
+		var in []reflect.Value
+		if withState {
+			in = append(in, reflect.ValueOf(L))
+		}
+		return L.callGoFunc(v, in, 1)
+	})
+}
+
+// callGoFunc calls fn with the values of in followed by the arguments from
+// arg on converted to its other parameters, and returns like a Go function
+// called by Lua, after pushing the results of fn.
+func (l *LuaState) callGoFunc(fn reflect.Value, in []reflect.Value, arg int) int {
+	t := fn.Type()
+	args, err := l.goFuncArgs(t, in, arg)
+	if err != nil {
+		return l.RaiseError(err)
+	}
+	out := fn.Call(args)
+	if t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return l.RaiseError(err)
+		}
+		out = out[:len(out)-1]
+	}
+	if !l.CheckStack(len(out)) {
+		return l.RaiseError(errStackOverflow)
+	}
+	for _, r := range out {
+		// Pointers to the type of a class are objects
+		if ot, ok := l.objectTypes[r.Type()]; ok && ot.class != nil {
+			l.pushObject(r)
+			continue
+		}
+		if err := l.Push(r.Interface()); err != nil {
+			return l.RaiseError(err)
+		}
+	}
+	return len(out)
+}
+
+// goFuncArgs converts the arguments from arg on to the parameters of the
+// function type t following the values of in.
+func (l *LuaState) goFuncArgs(t reflect.Type, in []reflect.Value, arg int) ([]reflect.Value, error) {
+	nargs := l.GetTop()
+	args := make([]reflect.Value, 0, t.NumIn())
+	args = append(args, in...)
+	fixed := t.NumIn()
+	if t.IsVariadic() {
+		fixed--
+	}
+	for i := len(in); i < fixed; i++ {
+		v, err := l.goFuncArg(arg, t.In(i))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+		arg++
+	}
+	if t.IsVariadic() {
+		et := t.In(fixed).Elem()
+		for ; arg <= nargs; arg++ {
+			v, err := l.goFuncArg(arg, et)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, v)
+		}
+	}
+	return args, nil
+}
+
+// goFuncArg converts argument arg to a value of type t.
+func (l *LuaState) goFuncArg(arg int, t reflect.Type) (reflect.Value, error) {
+	p := reflect.New(t)
+	tp := l.Type(arg)
+	if tp == LUA_TNIL || tp == LUA_TNONE {
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Map:
+			return p.Elem(), nil
+		}
+		return reflect.Value{}, l.argError(arg, typeExpected(t)+" expected, got "+l.argTypeName(arg), nil)
+	}
+	err := l.To(arg, p.Interface())
+	if err == nil {
+		return p.Elem(), nil
+	}
+	var te *TypeError
+	if errors.As(err, &te) {
+		if te.Path != "" {
+			return reflect.Value{}, l.argError(arg, fmt.Sprintf("%s expected at '%s', got %s", typeExpected(te.Type), te.Path, te.Value), err)
+		}
+		if tp == LUA_TNUMBER && isInteger(t) {
+			if _, ok := l.ToIntegerX(arg); !ok {
+				return reflect.Value{}, l.argError(arg, "number has no integer representation", err)
+			}
+			return reflect.Value{}, l.argError(arg, "number out of range", err)
+		}
+		return reflect.Value{}, l.argError(arg, typeExpected(t)+" expected, got "+l.argTypeName(arg), err)
+	}
+	return reflect.Value{}, l.argError(arg, err.Error(), err)
+}
+
+// argError builds the error of luaL_argerror for argument arg of the
+// running function.
+func (l *LuaState) argError(arg int, msg string, err error) error {
+	e := &ArgError{Arg: arg, Func: "?", Message: msg, Err: err}
+	ar, ok := l.GetStack(0)
+	if !ok || !l.GetInfo("n", ar) {
+		return e
+	}
+	if ar.NameWhat == "method" {
+		e.Arg--
+	}
+	if ar.Name != "" {
+		e.Func = ar.Name
+	}
+	return e
+}
+
+// argTypeName is the type name of argument arg in messages, like
+// luaL_typename but "no value" for a missing argument.
+func (l *LuaState) argTypeName(arg int) string {
+	if l.Type(arg) == LUA_TNONE {
+		return "no value"
+	}
+	return l.TypeName(l.Type(arg))
+}
+
+func isInteger(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+// typeExpected is the Lua type name of the values To stores in t.
+func typeExpected(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Pointer:
+		return typeExpected(t.Elem())
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string"
+		}
+		return "table"
+	case reflect.Array, reflect.Map, reflect.Struct:
+		return "table"
+	case reflect.Interface:
+		return "value"
+	}
+	if isInteger(t) {
+		return "number"
+	}
+	return t.String()
+}
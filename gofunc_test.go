@@ -0,0 +1,84 @@
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPushGoFunc(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.RegisterGoFunc("add", func(a, b int) int { return a + b })
+	L.RegisterGoFunc("join", func(sep string, parts ...string) string { return strings.Join(parts, sep) })
+	L.RegisterGoFunc("divmod", func(a, b int) (int, int, error) {
+		if b == 0 {
+			return 0, 0, errBoom
+		}
+		return a / b, a % b, nil
+	})
+	L.RegisterGoFunc("top", func(L *LuaState, n int) int { return L.GetTop() + n })
+	L.RegisterGoFunc("sum", func(p []point) (s point) {
+		for _, q := range p {
+			s.X, s.Y = s.X+q.X, s.Y+q.Y
+		}
+		return s
+	})
+	L.RegisterGoFunc("count", func(m map[string]int) int { return len(m) })
+	if err := L.DoStringErr(`
+		assert(add(2, 3) == 5)
+		assert(join("-", "a", "b", "c") == "a-b-c" and join(",") == "")
+		local q, r = divmod(7, 2)
+		assert(q == 3 and r == 1)
+		assert(top(10) == 11)
+		local s = sum({{X = 1, Y = 2}, {X = 3, Y = 4}})
+		assert(s.X == 4 and s.Y == 6)
+		assert(count(nil) == 0)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoStringErr(`divmod(1, 0)`); !errors.Is(err, errBoom) {
+		t.Errorf("got %v, want boom", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("PushGoFunc of a non function did not panic")
+		}
+	}()
+	L.PushGoFunc(42)
+}
+
+func TestPushGoFuncArgErrors(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.RegisterGoFunc("add", func(a, b int) int { return a + b })
+	L.RegisterGoFunc("small", func(n int8) int8 { return n })
+	L.RegisterGoFunc("sum", func(p []point) int { return len(p) })
+	for _, c := range []struct {
+		src, msg string
+		arg      int
+	}{
+		{`add(1, "x")`, "bad argument #2 to 'add' (number expected, got string)", 2},
+		{`add(1)`, "bad argument #2 to 'add' (number expected, got no value)", 2},
+		{`add(1.5, 1)`, "bad argument #1 to 'add' (number has no integer representation)", 1},
+		{`small(300)`, "bad argument #1 to 'small' (number out of range)", 1},
+		{`sum({{X = 1}, {X = {}}})`, "bad argument #1 to 'sum' (number expected at '[2].X', got table)", 1},
+		{`local f = add f(true, 1)`, "bad argument #1 to 'f' (number expected, got boolean)", 1},
+	} {
+		err := L.DoStringErr(c.src)
+		var ae *ArgError
+		if !errors.As(err, &ae) || ae.Arg != c.arg || ae.Error() != c.msg {
+			t.Errorf("%s: got %v, want %s", c.src, err, c.msg)
+			continue
+		}
+		var le *LuaError
+		if !errors.As(err, &le) || !strings.HasSuffix(le.Message, c.msg) {
+			t.Errorf("%s: got message %q", c.src, le.Message)
+		}
+	}
+	// Scripts see the message of luaL_argerror
+	if err := L.DoStringErr(`
+		local ok, e = pcall(add, 1, "x")
+		assert(tostring(e):find("bad argument #2 to '?' (number expected, got string)", 1, true), tostring(e))`); err != nil {
+		t.Error(err)
+	}
+}
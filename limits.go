@@ -0,0 +1,227 @@
+package lua
+
+/*
+#include <stddef.h>
+#include "wrapper.h"
+*/
+import "C"
+
+import (
+	"context"
+	"math"
+)
+
+// Most instructions run between two checks of the limits
+const limitCheckInterval = 1000
+
+// fuelMeter counts the instructions run against a budget. The budget of a
+// call made with PCallFuel is nested in the one set with SetFuel, the
+// instructions are charged to both.
+type fuelMeter struct {
+	budget int64
+	used   int64
+	parent *fuelMeter
+}
+
+func (f *fuelMeter) charge(n int64) {
+	for ; f != nil; f = f.parent {
+		f.used += n
+	}
+}
+
+// remaining returns the fuel left in the tightest budget of the chain.
+func (f *fuelMeter) remaining() int64 {
+	left := int64(math.MaxInt64)
+	for ; f != nil; f = f.parent {
+		if n := f.budget - f.used; n < left {
+			left = n
+		}
+	}
+	return left
+}
+
+// limited reports whether h enforces a limit on the call in progress.
+func (h *luaHook) limited() bool {
+	return h.ctx != nil || h.fuel != nil
+}
+
+// checkInterval is the number of instructions between two checks of the
+// limits of h, the fuel is checked again exactly when it runs out.
+func (h *luaHook) checkInterval() int {
+	n := limitCheckInterval
+	if h.fuel != nil {
+		if left := h.fuel.remaining(); left < int64(n) {
+			n = int(left)
+		}
+		if n < 1 {
+			n = 1
+		}
+	}
+	return n
+}
+
+// check returns the error to abort the running script with, if any.
+func (h *luaHook) check(L *LuaState) error {
+	if h.ctx != nil {
+		if err := h.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if h.fuel != nil && h.fuel.remaining() <= 0 {
+		return ErrFuelExhausted
+	}
+	return nil
+}
+
+// withHook runs call with the hook of l extended by limit, then restores the
+// previous hook.
+func (l *LuaState) withHook(limit func(h *luaHook), call func() error) error {
+	old, hadHook := l.hooks[l.luaState]
+	h := l.copyHook()
+	limit(h)
+	l.installHook(h)
+	defer func() {
+		if hadHook {
+			l.installHook(old)
+		} else {
+			l.installHook(nil)
+		}
+	}()
+	return call()
+}
+
+// PCallContext is PCallErr for a call that is aborted once ctx is done. The
+// context is checked every few instructions from a count hook, the call then
+// fails with a *LuaError for which errors.Is(err, ctx.Err()) is true. Once
+// the context is done the error is raised again on every instruction, so
+// scripts catching it with pcall cannot keep running. Coroutines resumed
+// during the call are checked as well, even those created before it.
+func (l *LuaState) PCallContext(ctx context.Context, nargs, nresults int) error {
+	if err := ctx.Err(); err != nil {
+		l.Pop(nargs + 1)
+		return limitError(err)
+	}
+	return l.withHook(func(h *luaHook) { h.ctx = ctx }, func() error {
+		return l.PCallErr(nargs, nresults, 0)
+	})
+}
+
+// limitError is the error of a call not made because its limit is already
+// reached, a *LuaError like the one raised by the hook during the call.
+func limitError(err error) *LuaError {
+	return &LuaError{Status: LUA_ERRRUN, Message: err.Error(), Value: err.Error(), Cause: err}
+}
+
+// DoStringContext is DoStringErr with the script aborted once ctx is done,
+// see PCallContext.
+func (l *LuaState) DoStringContext(ctx context.Context, src string) error {
+	if status := l.loadString(src); status != LUA_OK {
+		return l.popError(status)
+	}
+	return l.PCallContext(ctx, 0, LUA_MULTRET)
+}
+
+// DoFileContext is DoFileErr with the script aborted once ctx is done, see
+// PCallContext.
+func (l *LuaState) DoFileContext(ctx context.Context, path string) error {
+	if status := l.loadFileX(path, ""); status != LUA_OK {
+		return l.popError(status)
+	}
+	return l.PCallContext(ctx, 0, LUA_MULTRET)
+}
+
+// WithMemoryLimit limits the memory of the state to bytes, see
+// SetMemoryLimit.
+func WithMemoryLimit(bytes int) Option {
+	return func(L *LuaState) {
+		L.SetMemoryLimit(bytes)
+	}
+}
+
+// SetMemoryLimit limits the memory allocated by the state to bytes, 0
+// removes the limit. Allocations going over it fail, scripts then get a
+// memory error (LUA_ERRMEM, ErrMem) after Lua has tried a full garbage
+// collection. Go functions and hooks called by Lua run with the limit lifted,
+// so the Lua API calls they make cannot fail, and the memory error is raised
+// once they return if the state is still over the limit. Elsewhere, outside
+// of a protected call the error is fatal, so the limit must leave room for
+// the standard libraries and the values pushed from Go.
+func (l *LuaState) SetMemoryLimit(bytes int) {
+	if l.alloc != nil {
+		l.alloc.limit = C.size_t(bytes)
+	}
+}
+
+// MemoryLimit returns the memory limit of the state, 0 when there is none.
+func (l *LuaState) MemoryLimit() int {
+	if l.alloc == nil {
+		return 0
+	}
+	return int(l.alloc.limit)
+}
+
+// MemoryUsage returns the bytes currently allocated by the state and the most
+// it ever had allocated.
+func (l *LuaState) MemoryUsage() (current, peak int) {
+	if l.alloc == nil {
+		return 0, 0
+	}
+	return int(l.alloc.used), int(l.alloc.peak)
+}
+
+// SetFuel limits everything run on l from now on to fuel VM instructions,
+// counted with a count hook. Once the fuel is exhausted the running script
+// fails with a *LuaError for which errors.Is(err, ErrFuelExhausted) is true,
+// and keeps failing until SetFuel is called again. A negative fuel removes
+// the limit.
+//
+// Coroutines resumed from l are limited too, even those created before the
+// call to SetFuel. Instructions run by a coroutine are charged in batches of
+// up to limitCheckInterval, a coroutine that finishes in between is not
+// charged its last batch.
+func (l *LuaState) SetFuel(fuel int64) {
+	h := l.copyHook()
+	h.fuel = nil
+	if fuel >= 0 {
+		h.fuel = &fuelMeter{budget: fuel}
+	}
+	l.installHook(h)
+}
+
+// Fuel returns the fuel left from the budget set with SetFuel, or -1 when
+// there is none.
+func (l *LuaState) Fuel() int64 {
+	h, ok := l.hooks[l.luaState]
+	if !ok || h.fuel == nil {
+		return -1
+	}
+	left := h.fuel.remaining() - int64(C.golua_hookelapsed(l.luaState))
+	if left < 0 {
+		left = 0
+	}
+	return left
+}
+
+// PCallFuel is PCallErr for a call allowed to run at most fuel VM
+// instructions, see SetFuel. It returns the fuel the call consumed, which
+// is also charged to the budget of SetFuel if any.
+func (l *LuaState) PCallFuel(fuel int64, nargs, nresults int) (used int64, err error) {
+	if fuel <= 0 {
+		l.Pop(nargs + 1)
+		return 0, limitError(ErrFuelExhausted)
+	}
+	meter := &fuelMeter{budget: fuel}
+	err = l.withHook(func(h *luaHook) { meter.parent, h.fuel = h.fuel, meter }, func() error {
+		return l.PCallErr(nargs, nresults, 0)
+	})
+	return meter.used, err
+}
+
+// DoStringFuel is DoStringErr with the script allowed to run at most fuel
+// VM instructions, see PCallFuel.
+func (l *LuaState) DoStringFuel(fuel int64, src string) (used int64, err error) {
+	if status := l.loadString(src); status != LUA_OK {
+		return 0, l.popError(status)
+	}
+	return l.PCallFuel(fuel, 0, LUA_MULTRET)
+}
@@ -0,0 +1,187 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// within stops the tests if f has not returned after d, the state it runs
+// on cannot be closed while it runs.
+func within(d time.Duration, f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		panic(fmt.Sprintf("still running after %v", d))
+	}
+}
+
+func TestDoStringContext(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var err error
+	within(5*time.Second, func() {
+		err = L.DoStringContext(ctx, `while true do pcall(function() while true do end end) end`)
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the deadline", err)
+	}
+	// The hook is gone once the call returned
+	if err := L.DoStringErr(`for i = 1, 10000 do end`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPCallContextDone(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	L.LoadString(`return 1`)
+	err := L.PCallContext(ctx, 0, 1)
+	var le *LuaError
+	if !errors.As(err, &le) || !errors.Is(err, context.Canceled) || !errors.Is(err, ErrRun) {
+		t.Errorf("got %#v, want a *LuaError for the canceled context", err)
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("stack has %d values, want 0", L.GetTop())
+	}
+}
+
+func TestDoStringContextCoroutine(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	if err := L.DoStringErr(`co = coroutine.create(function() while true do end end)`); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var err error
+	within(5*time.Second, func() {
+		err = L.DoStringContext(ctx, `local ok, e = coroutine.resume(co) error(e, 0)`)
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the deadline", err)
+	}
+	// Coroutines resumed without a limit are not hooked anymore
+	if err := L.DoStringErr(`
+		local co = coroutine.wrap(function() for i = 1, 10000 do coroutine.yield(i) end end)
+		for i = 1, 10000 do assert(co() == i) end`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDoStringFuel(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	used, err := L.DoStringFuel(100000, `for i = 1, 100 do end`)
+	if err != nil || used <= 0 || used >= 100000 {
+		t.Errorf("DoStringFuel = %d, %v", used, err)
+	}
+	used, err = L.DoStringFuel(100000, `while true do pcall(function() while true do end end) end`)
+	if !errors.Is(err, ErrFuelExhausted) || used < 100000 {
+		t.Errorf("DoStringFuel of a loop = %d, %v", used, err)
+	}
+	// The budget is nested in the one of SetFuel
+	L.SetFuel(50000)
+	if _, err := L.DoStringFuel(100000, `while true do end`); !errors.Is(err, ErrFuelExhausted) {
+		t.Errorf("got %v, want the fuel of SetFuel exhausted", err)
+	}
+	if left := L.Fuel(); left != 0 {
+		t.Errorf("Fuel = %d, want 0", left)
+	}
+	L.SetFuel(-1)
+	if err := L.DoStringErr(`for i = 1, 100000 do end`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPCallFuelNone(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.LoadString(`return 1`)
+	used, err := L.PCallFuel(0, 0, 1)
+	var le *LuaError
+	if !errors.As(err, &le) || !errors.Is(err, ErrFuelExhausted) || used != 0 {
+		t.Errorf("got %d, %#v, want a *LuaError for the fuel", used, err)
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("stack has %d values, want 0", L.GetTop())
+	}
+}
+
+func TestDoStringFuelCoroutine(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	if err := L.DoStringErr(`co = coroutine.create(function() while true do end end)`); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	within(5*time.Second, func() {
+		_, err = L.DoStringFuel(100000, `coroutine.resume(co)`)
+	})
+	if !errors.Is(err, ErrFuelExhausted) {
+		t.Errorf("got %v, want the fuel exhausted", err)
+	}
+	// Coroutines yielding often are charged too
+	_, err = L.DoStringFuel(100000, `
+		local gen = coroutine.wrap(function() while true do coroutine.yield() end end)
+		while true do gen() end`)
+	if !errors.Is(err, ErrFuelExhausted) {
+		t.Errorf("got %v, want the fuel exhausted", err)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	L := NewLuaState(WithMemoryLimit(0))
+	defer L.Close()
+	used, _ := L.MemoryUsage()
+	L.SetMemoryLimit(used + 1<<20)
+	if n := L.MemoryLimit(); n != used+1<<20 {
+		t.Errorf("MemoryLimit = %d", n)
+	}
+	err := L.DoStringErr(`local t = {} for i = 1, 1e7 do t[i] = i end`)
+	if !errors.Is(err, ErrMem) {
+		t.Errorf("got %v, want a memory error", err)
+	}
+	L.GCCollect()
+	if err := L.DoStringErr(`local t = {} for i = 1, 100 do t[i] = i end`); err != nil {
+		t.Error(err)
+	}
+	if current, peak := L.MemoryUsage(); current > L.MemoryLimit() || peak > L.MemoryLimit() {
+		t.Errorf("MemoryUsage = %d, %d over the limit %d", current, peak, L.MemoryLimit())
+	}
+}
+
+func TestMemoryLimitGoFunction(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.SetMemoryLimit(L.GCCount() + 200<<10)
+	L.RegisterGoFunc("mk", func(n int) []int { return make([]int, n) })
+	if err := L.DoStringErr(`
+		local ok, e = pcall(mk, 1000000)
+		assert(not ok and e == "not enough memory", e)
+		assert(#mk(10) == 10)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.DoStringErr(`mk(1000000)`); !errors.Is(err, ErrMem) {
+		t.Errorf("got %v, want a memory error", err)
+	}
+	// Lua called back from the Go function is limited again
+	L.RegisterGoFunc("call", func(L *LuaState) error {
+		L.PushValue(1)
+		return L.PCallErr(0, 0, 0)
+	})
+	if err := L.DoStringErr(`call(function() local t = {} for i = 1, 1e7 do t[i] = i end end)`); !errors.Is(err, ErrMem) {
+		t.Errorf("got %v, want a memory error", err)
+	}
+}
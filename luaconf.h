@@ -786,5 +786,15 @@
 ** without modifying the main part of the file.
 */
 
+/*
+** The Go wrapper forgets the hooks of the threads Lua frees and hooks the
+** coroutines it resumes, see wrapper.c
+*/
+struct lua_State;
+void golua_userstatefree (struct lua_State *L, struct lua_State *L1);
+void golua_userstateresume (struct lua_State *L, int n);
+#define luai_userstatefree(L,L1)	golua_userstatefree(L,L1)
+#define luai_userstateresume(L,n)	golua_userstateresume(L,n)
+
 #endif
 
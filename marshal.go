@@ -0,0 +1,539 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// UnsupportedTypeError is returned by Push and To for a Go type that has no
+// Lua equivalent, such as a channel or a complex number.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "lua: unsupported type " + e.Type.String()
+}
+
+// CycleError is returned by Push for a Go value that refers to itself, and
+// by To for a Lua table that does.
+type CycleError struct {
+	// Type is the Go type at which the cycle was found.
+	Type reflect.Type
+	// Path is the path of the value in the Lua value, for To.
+	Path string
+}
+
+func (e *CycleError) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("lua: encountered a cycle at %s decoding %s", e.Path, e.Type)
+	}
+	return "lua: encountered a cycle via " + e.Type.String()
+}
+
+// TypeError is returned by To when a Lua value cannot be stored in the Go
+// value, like a string into an int or a float into an int8 it overflows.
+type TypeError struct {
+	// Value describes the Lua value, "string", "number 3.5", ...
+	Value string
+	// Type is the Go type the value could not be stored in.
+	Type reflect.Type
+	// Path is the path of the value in the Lua value, like "a.b[2]", empty
+	// for the value itself.
+	Path string
+}
+
+func (e *TypeError) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("lua: cannot store %s into Go value %s of type %s", e.Value, e.Path, e.Type)
+	}
+	return fmt.Sprintf("lua: cannot store %s into Go value of type %s", e.Value, e.Type)
+}
+
+var errStackOverflow = errors.New("lua: stack overflow converting a nested value")
+
+// Push pushes v converted to Lua. Booleans, numbers and strings become the
+// same Lua values, []byte becomes a string, slices and arrays become
+// sequences, maps become tables keyed by their converted keys and structs
+// become tables keyed by their exported field names, see SetFieldNaming.
+// Pointers and interfaces push the value they point to, nil pushes nil.
+// Values that refer to themselves return a *CycleError. Nothing is pushed
+// on error.
+func (l *LuaState) Push(v any) error {
+	e := &encoder{l: l, visiting: make(map[visit]struct{})}
+	top := l.GetTop()
+	if err := e.push(reflect.ValueOf(v)); err != nil {
+		l.SetTop(top)
+		return err
+	}
+	return nil
+}
+
+// visit identifies a pointer, map or slice being pushed, to find cycles.
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+type encoder struct {
+	l        *LuaState
+	visiting map[visit]struct{}
+}
+
+// enter marks v as being pushed, it fails when v is already being pushed
+// further up, and returns the function to call once it is pushed.
+func (e *encoder) enter(v reflect.Value) (func(), error) {
+	k := visit{ptr: v.Pointer(), typ: v.Type()}
+	if v.Kind() == reflect.Slice {
+		k.len = v.Len()
+	}
+	if _, ok := e.visiting[k]; ok {
+		return nil, &CycleError{Type: v.Type()}
+	}
+	e.visiting[k] = struct{}{}
+	return func() { delete(e.visiting, k) }, nil
+}
+
+func (e *encoder) push(v reflect.Value) error {
+	l := e.l
+	if !l.CheckStack(3) {
+		return errStackOverflow
+	}
+	if !v.IsValid() {
+		l.PushNil()
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		l.PushBoolean(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		l.PushInteger(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n := v.Uint(); n > math.MaxInt64 {
+			l.PushNumber(float64(n))
+		} else {
+			l.PushInteger(int64(n))
+		}
+	case reflect.Float32, reflect.Float64:
+		l.PushNumber(v.Float())
+	case reflect.String:
+		l.PushLString(v.String())
+	case reflect.Interface:
+		return e.push(v.Elem())
+	case reflect.Pointer:
+		if v.IsNil() {
+			l.PushNil()
+			return nil
+		}
+		leave, err := e.enter(v)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		return e.push(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			l.PushNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			l.PushBytes(v.Bytes())
+			return nil
+		}
+		leave, err := e.enter(v)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		return e.pushSequence(v)
+	case reflect.Array:
+		return e.pushSequence(v)
+	case reflect.Map:
+		if v.IsNil() {
+			l.PushNil()
+			return nil
+		}
+		leave, err := e.enter(v)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		return e.pushMap(v)
+	case reflect.Struct:
+		return e.pushStruct(v)
+	default:
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	return nil
+}
+
+func (e *encoder) pushSequence(v reflect.Value) error {
+	l := e.l
+	n := v.Len()
+	l.CreateTable(n, 0)
+	for i := 0; i < n; i++ {
+		if err := e.push(v.Index(i)); err != nil {
+			return err
+		}
+		l.RawSetI(-2, int64(i+1))
+	}
+	return nil
+}
+
+func (e *encoder) pushMap(v reflect.Value) error {
+	l := e.l
+	l.CreateTable(0, v.Len())
+	for it := v.MapRange(); it.Next(); {
+		k := it.Key()
+		for k.Kind() == reflect.Interface && !k.IsNil() {
+			k = k.Elem()
+		}
+		// Lua raises an error for nil and NaN keys
+		switch k.Kind() {
+		case reflect.Bool, reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		case reflect.Float32, reflect.Float64:
+			if math.IsNaN(k.Float()) {
+				return fmt.Errorf("lua: cannot use NaN as a table key in %s", v.Type())
+			}
+		default:
+			return &UnsupportedTypeError{Type: it.Key().Type()}
+		}
+		if err := e.push(k); err != nil {
+			return err
+		}
+		if err := e.push(it.Value()); err != nil {
+			return err
+		}
+		l.RawSet(-3)
+	}
+	return nil
+}
+
+func (e *encoder) pushStruct(v reflect.Value) error {
+	l := e.l
+	fields := typeFields(v.Type(), l.fieldNaming)
+	l.CreateTable(0, len(fields))
+	for _, f := range fields {
+		fv, ok := fieldByIndex(v, f.index, false)
+		if !ok || f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		l.PushLString(f.name)
+		if err := e.push(fv); err != nil {
+			return err
+		}
+		l.RawSet(-3)
+	}
+	return nil
+}
+
+// To stores the Lua value at idx into the Go value out points to, the
+// reverse of Push. Tables are stored into slices, arrays, maps and structs,
+// a sequence into an any becomes []any and other tables map[string]any, or
+// map[any]any when not all of their keys are strings. Table fields missing
+// from a struct, or nil, leave the Go field unchanged. Nil sets pointers,
+// slices, maps and interfaces to nil and leaves other values unchanged.
+// Tables are read without calling metamethods. A table referring to itself
+// returns a *CycleError, a value that does not fit a *TypeError.
+func (l *LuaState) To(idx int, out any) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("lua: To needs a non-nil pointer, not %T", out)
+	}
+	d := &decoder{l: l, visiting: make(map[uintptr]struct{})}
+	top := l.GetTop()
+	err := d.to(l.AbsIndex(idx), rv.Elem(), "")
+	l.SetTop(top)
+	return err
+}
+
+type decoder struct {
+	l *LuaState
+	// Tables being decoded, to find cycles
+	visiting map[uintptr]struct{}
+}
+
+func (d *decoder) typeError(idx int, t reflect.Type, path string) error {
+	l := d.l
+	desc := l.TypeName(l.Type(idx))
+	if l.Type(idx) == LUA_TNUMBER {
+		// Not ToLString, which would turn the number into a string
+		desc = fmt.Sprint("number ", l.errorValue(idx))
+	}
+	return &TypeError{Value: desc, Type: t, Path: path}
+}
+
+// enter marks the table at idx as being decoded, it fails when the table is
+// already being decoded further up, and returns the function to call once it
+// is decoded.
+func (d *decoder) enter(idx int, t reflect.Type, path string) (func(), error) {
+	p := uintptr(d.l.ToPointer(idx))
+	if _, ok := d.visiting[p]; ok {
+		return nil, &CycleError{Type: t, Path: path}
+	}
+	d.visiting[p] = struct{}{}
+	return func() { delete(d.visiting, p) }, nil
+}
+
+// to decodes the value at the absolute index idx into v.
+func (d *decoder) to(idx int, v reflect.Value, path string) error {
+	l := d.l
+	if !l.CheckStack(3) {
+		return errStackOverflow
+	}
+	tp := l.Type(idx)
+	if tp == LUA_TUSERDATA {
+		if obj, ok := l.toObject(idx); ok {
+			switch {
+			case obj.Type().AssignableTo(v.Type()):
+				v.Set(obj)
+				return nil
+			case obj.Type().Elem().AssignableTo(v.Type()):
+				v.Set(obj.Elem())
+				return nil
+			}
+		}
+	}
+	if tp == LUA_TNIL || tp == LUA_TNONE {
+		switch v.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.to(idx, v.Elem(), path)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return &UnsupportedTypeError{Type: v.Type()}
+		}
+		x, err := d.value(idx, path)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+		return nil
+	case reflect.Bool:
+		if tp != LUA_TBOOLEAN {
+			return d.typeError(idx, v.Type(), path)
+		}
+		v.SetBool(l.ToBoolean(idx))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := l.ToIntegerX(idx)
+		if tp != LUA_TNUMBER || !ok || v.OverflowInt(n) {
+			return d.typeError(idx, v.Type(), path)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := l.ToIntegerX(idx)
+		if tp != LUA_TNUMBER || !ok || n < 0 || v.OverflowUint(uint64(n)) {
+			return d.typeError(idx, v.Type(), path)
+		}
+		v.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		if tp != LUA_TNUMBER {
+			return d.typeError(idx, v.Type(), path)
+		}
+		f := l.ToNumber(idx)
+		if v.OverflowFloat(f) {
+			return d.typeError(idx, v.Type(), path)
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		if tp != LUA_TSTRING {
+			return d.typeError(idx, v.Type(), path)
+		}
+		v.SetString(l.ToLString(idx))
+	case reflect.Slice:
+		if tp == LUA_TSTRING && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(l.ToBytes(idx))
+			return nil
+		}
+		if tp != LUA_TTABLE {
+			return d.typeError(idx, v.Type(), path)
+		}
+		leave, err := d.enter(idx, v.Type(), path)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		n := int(l.RawLen(idx))
+		s := reflect.MakeSlice(v.Type(), n, n)
+		if err := d.sequence(idx, s, path); err != nil {
+			return err
+		}
+		v.Set(s)
+	case reflect.Array:
+		if tp != LUA_TTABLE {
+			return d.typeError(idx, v.Type(), path)
+		}
+		leave, err := d.enter(idx, v.Type(), path)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		v.Set(reflect.Zero(v.Type()))
+		return d.sequence(idx, v, path)
+	case reflect.Map:
+		if tp != LUA_TTABLE {
+			return d.typeError(idx, v.Type(), path)
+		}
+		leave, err := d.enter(idx, v.Type(), path)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		return d.toMap(idx, v, path)
+	case reflect.Struct:
+		if tp != LUA_TTABLE {
+			return d.typeError(idx, v.Type(), path)
+		}
+		leave, err := d.enter(idx, v.Type(), path)
+		if err != nil {
+			return err
+		}
+		defer leave()
+		return d.toStruct(idx, v, path)
+	default:
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	return nil
+}
+
+// sequence decodes the elements 1 to v.Len() of the table at idx into the
+// slice or array v.
+func (d *decoder) sequence(idx int, v reflect.Value, path string) error {
+	l := d.l
+	n := int(l.RawLen(idx))
+	if n > v.Len() {
+		n = v.Len()
+	}
+	for i := 0; i < n; i++ {
+		l.RawGetI(idx, int64(i+1))
+		err := d.to(l.GetTop(), v.Index(i), path+"["+strconv.Itoa(i+1)+"]")
+		l.Pop(1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) toMap(idx int, v reflect.Value, path string) error {
+	l := d.l
+	t := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(t))
+	}
+	l.PushNil()
+	for l.Next(idx) != 0 {
+		top := l.GetTop()
+		k := reflect.New(t.Key()).Elem()
+		if err := d.to(top-1, k, path); err != nil {
+			return err
+		}
+		e := reflect.New(t.Elem()).Elem()
+		if err := d.to(top, e, keyPath(path, k)); err != nil {
+			return err
+		}
+		v.SetMapIndex(k, e)
+		l.Pop(1)
+	}
+	return nil
+}
+
+func (d *decoder) toStruct(idx int, v reflect.Value, path string) error {
+	l := d.l
+	for _, f := range typeFields(v.Type(), l.fieldNaming) {
+		l.PushLString(f.name)
+		if l.RawGet(idx) == LUA_TNIL {
+			l.Pop(1)
+			continue
+		}
+		fv, ok := fieldByIndex(v, f.index, true)
+		if !ok {
+			// Behind a nil pointer to an unexported struct
+			l.Pop(1)
+			continue
+		}
+		err := d.to(l.GetTop(), fv, joinPath(path, f.name))
+		l.Pop(1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// value decodes the value at the absolute index idx for an any.
+func (d *decoder) value(idx int, path string) (any, error) {
+	l := d.l
+	if l.Type(idx) != LUA_TTABLE {
+		switch l.Type(idx) {
+		case LUA_TNIL, LUA_TNONE, LUA_TBOOLEAN, LUA_TNUMBER, LUA_TSTRING:
+			return l.errorValue(idx), nil
+		default:
+			return nil, d.typeError(idx, reflect.TypeOf((*any)(nil)).Elem(), path)
+		}
+	}
+	leave, err := d.enter(idx, reflect.TypeOf((*any)(nil)).Elem(), path)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	n := int(l.RawLen(idx))
+	keys, allStrings := 0, true
+	l.PushNil()
+	for l.Next(idx) != 0 {
+		keys++
+		allStrings = allStrings && l.Type(-2) == LUA_TSTRING
+		l.Pop(1)
+	}
+	if n > 0 && keys == n {
+		s := make([]any, n)
+		for i := range s {
+			l.RawGetI(idx, int64(i+1))
+			s[i], err = d.value(l.GetTop(), path+"["+strconv.Itoa(i+1)+"]")
+			l.Pop(1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+	var m reflect.Value
+	if allStrings {
+		m = reflect.ValueOf(make(map[string]any, keys))
+	} else {
+		m = reflect.ValueOf(make(map[any]any, keys))
+	}
+	return m.Interface(), d.toMap(idx, m, path)
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func keyPath(path string, k reflect.Value) string {
+	if k.Kind() == reflect.String {
+		return joinPath(path, k.String())
+	}
+	return fmt.Sprintf("%s[%v]", path, k.Interface())
+}
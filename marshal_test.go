@@ -0,0 +1,121 @@
+package lua
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type point struct {
+	X, Y int
+}
+
+type shape struct {
+	Name   string
+	Points []point
+	Tags   map[string]bool
+	Scale  float64
+	Data   []byte
+	Parent *shape
+	hidden int
+}
+
+func TestPushTo(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	in := shape{
+		Name:   "tri",
+		Points: []point{{0, 0}, {1, 0}, {0, 1}},
+		Tags:   map[string]bool{"closed": true},
+		Scale:  1.5,
+		Data:   []byte{0, 1, 2},
+		Parent: &shape{Name: "root"},
+		hidden: 7,
+	}
+	if err := L.Push(in); err != nil {
+		t.Fatal(err)
+	}
+	L.SetGlobal("s")
+	if err := L.DoStringErr(`
+		assert(s.Name == "tri" and #s.Points == 3 and s.Points[2].X == 1)
+		assert(s.Tags.closed and s.Scale == 1.5 and s.Data == "\0\1\2")
+		assert(s.Parent.Name == "root" and s.hidden == nil)
+		s.Points[4] = {X = 2, Y = 2}`); err != nil {
+		t.Fatal(err)
+	}
+	L.GetGlobal("s")
+	var out shape
+	if err := L.To(-1, &out); err != nil {
+		t.Fatal(err)
+	}
+	L.Pop(1)
+	in.Points = append(in.Points, point{2, 2})
+	in.Parent.Tags = nil
+	in.hidden = 0
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("stack has %d values, want 0", L.GetTop())
+	}
+}
+
+func TestToAny(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	if err := L.DoStringErr(`v = {1, "two", {x = 3}, {[true] = 4}}`); err != nil {
+		t.Fatal(err)
+	}
+	L.GetGlobal("v")
+	var v any
+	if err := L.To(-1, &v); err != nil {
+		t.Fatal(err)
+	}
+	want := []any{int64(1), "two", map[string]any{"x": int64(3)}, map[any]any{true: int64(4)}}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("got %#v, want %#v", v, want)
+	}
+}
+
+func TestPushToErrors(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	s := &shape{Name: "loop"}
+	s.Parent = s
+	var ce *CycleError
+	if err := L.Push(s); !errors.As(err, &ce) || L.GetTop() != 0 {
+		t.Errorf("Push of a cycle = %v with %d values pushed", err, L.GetTop())
+	}
+	var ue *UnsupportedTypeError
+	if err := L.Push(make(chan int)); !errors.As(err, &ue) {
+		t.Errorf("Push of a channel = %v", err)
+	}
+
+	if err := L.DoStringErr(`
+		bad = {Name = "x", Points = {{X = 1}, {X = "one"}}}
+		small = 300
+		loop = {} loop.Parent = loop`); err != nil {
+		t.Fatal(err)
+	}
+	var out shape
+	var te *TypeError
+	L.GetGlobal("bad")
+	if err := L.To(-1, &out); !errors.As(err, &te) || te.Path != "Points[2].X" || te.Value != "string" {
+		t.Errorf("To with a bad field = %v", err)
+	}
+	L.GetGlobal("small")
+	var i8 int8
+	if err := L.To(-1, &i8); !errors.As(err, &te) || te.Value != "number 300" {
+		t.Errorf("To of 300 into an int8 = %v", err)
+	}
+	L.GetGlobal("loop")
+	if err := L.To(-1, &out); !errors.As(err, &ce) || ce.Path != "Parent" {
+		t.Errorf("To of a cycle = %v", err)
+	}
+	if err := L.To(-1, out); err == nil {
+		t.Error("To without a pointer succeeded")
+	}
+	if L.GetTop() != 3 {
+		t.Errorf("stack has %d values, want 3", L.GetTop())
+	}
+}
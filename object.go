@@ -0,0 +1,267 @@
+package lua
+
+/*
+#include "lua.h"
+extern int object_gc(lua_State *L);
+*/
+import "C"
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Field of the metatables of objects marking them as such
+const objectMetaKey = "golua.object"
+
+// objectType is what a state knows of a pointer type pushed with PushObject.
+type objectType struct {
+	// Registry name of the metatable
+	name string
+	// Exported fields, methods and the properties of its class
+	fields  map[string]field
+	methods map[string]bool
+	props   map[string]property
+	class   *Class
+}
+
+// PushObject pushes the Go pointer ptr as a full userdata, an object, or nil
+// when ptr is nil. The object keeps ptr alive until Lua collects it.
+//
+// Objects of a type share a metatable created on first use. Indexing an
+// object reads the exported field of that name, see SetFieldNaming, or
+// returns the method of that name to call as obj:Method(...) with the
+// arguments converted like PushGoFunc does. Struct fields, and non nil
+// pointers to structs, are returned as objects pointing into ptr, other
+// fields as with Push. Assigning to a field stores the value with To. To and
+// the functions pushed with PushGoFunc accept objects for parameters of the
+// type of ptr, or of the type it points to which then gets a copy.
+//
+// PushObject panics if ptr is not a pointer or nil.
+func (l *LuaState) PushObject(ptr any) {
+	if ptr == nil {
+		l.PushNil()
+		return
+	}
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Pointer {
+		panic(fmt.Sprintf("lua: PushObject needs a pointer, not %T", ptr))
+	}
+	l.pushObject(v)
+}
+
+func (l *LuaState) pushObject(v reflect.Value) {
+	if v.IsNil() {
+		l.PushNil()
+		return
+	}
+	id := l.objectId
+	l.objectId++
+	l.objects[id] = v
+	*(*int64)(l.NewUserDataUV(8, 0)) = id
+	l.pushObjectMeta(v.Type())
+	l.SetMetaTable(-2)
+}
+
+// ToObject returns the Go pointer of the object at idx, or nil when the
+// value is not an object.
+func (l *LuaState) ToObject(idx int) any {
+	if v, ok := l.toObject(idx); ok {
+		return v.Interface()
+	}
+	return nil
+}
+
+func (l *LuaState) toObject(idx int) (reflect.Value, bool) {
+	id, ok := l.toObjectId(idx)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	v, ok := l.objects[id]
+	return v, ok
+}
+
+// toObjectId returns the id held by the object at idx, false when the value is
+// not an object.
+func (l *LuaState) toObjectId(idx int) (int64, bool) {
+	if l.Type(idx) != LUA_TUSERDATA || l.RawLen(idx) != 8 || l.GetMetaTable(idx) == 0 {
+		return 0, false
+	}
+	l.PushString(objectMetaKey)
+	isObject := l.RawGet(-2) != LUA_TNIL
+	l.Pop(2)
+	if !isObject {
+		return 0, false
+	}
+	return *(*int64)(l.ToUserData(idx)), true
+}
+
+//export object_gc
+func object_gc(l *C.lua_State) C.int {
+	L := stateOf(l)
+	// Scripts can reach __gc with debug.getmetatable and pass it anything
+	if id, ok := L.toObjectId(1); ok {
+		delete(L.objects, id)
+	}
+	return 0
+}
+
+// pushObjectMeta pushes the metatable of the objects of the pointer type t,
+// creating it on first use.
+func (l *LuaState) pushObjectMeta(t reflect.Type) *objectType {
+	if ot, ok := l.objectTypes[t]; ok {
+		l.LGetMetaTable(ot.name)
+		return ot
+	}
+	ot := &objectType{
+		name:    objectMetaKey + "." + strconv.Itoa(len(l.objectTypes)),
+		methods: make(map[string]bool),
+		props:   make(map[string]property),
+	}
+	l.objectTypes[t] = ot
+	l.NewMetaTable(ot.name)
+	l.PushString(objectMetaKey)
+	l.PushBoolean(true)
+	l.RawSet(-3)
+	l.PushString(t.String())
+	l.SetField(-2, "__name")
+	l.PushCFunction((C.lua_CFunction)(C.object_gc))
+	l.SetField(-2, "__gc")
+	l.PushBoolean(false)
+	l.SetField(-2, "__metatable")
+
+	if t.Elem().Kind() == reflect.Struct {
+		ot.fields = make(map[string]field)
+		for _, f := range typeFields(t.Elem(), l.fieldNaming) {
+			ot.fields[f.name] = f
+		}
+	}
+	// Methods are kept in the metatable under their Go names, which
+	// cannot clash with metamethods as they start with a capital
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		ot.methods[m.Name] = true
+		l.pushMethod(t, m.Func)
+		l.SetField(-2, m.Name)
+	}
+	l.PushFunction(func(L *LuaState) int {
+		obj, err := L.checkObject(1, t)
+		if err != nil {
+			return L.RaiseError(err)
+		}
+		if L.Type(2) != LUA_TSTRING {
+			L.PushNil()
+			return 1
+		}
+		key := L.ToString(2)
+		if p, ok := ot.props[key]; ok {
+			if !p.get.IsValid() {
+				return L.RaiseError(fmt.Errorf("property '%s' of %s is write-only", key, t))
+			}
+			return L.callGoFunc(p.get, []reflect.Value{obj}, L.GetTop()+1)
+		}
+		if f, ok := ot.fields[key]; ok {
+			fv, ok := fieldByIndex(obj.Elem(), f.index, false)
+			if !ok {
+				L.PushNil()
+				return 1
+			}
+			return L.pushField(fv)
+		}
+		if !ot.methods[key] {
+			L.PushNil()
+			return 1
+		}
+		L.GetMetaTable(1)
+		L.PushValue(2)
+		L.RawGet(-2)
+		return 1
+	})
+	l.SetField(-2, "__index")
+	l.PushFunction(func(L *LuaState) int {
+		obj, err := L.checkObject(1, t)
+		if err != nil {
+			return L.RaiseError(err)
+		}
+		if L.Type(2) != LUA_TSTRING {
+			return L.RaiseError(fmt.Errorf("no field %s in %s", L.TypeName(L.Type(2)), t))
+		}
+		key := L.ToString(2)
+		if p, ok := ot.props[key]; ok {
+			if !p.set.IsValid() {
+				return L.RaiseError(fmt.Errorf("property '%s' of %s is read-only", key, t))
+			}
+			return L.callGoFunc(p.set, []reflect.Value{obj}, 3)
+		}
+		f, ok := ot.fields[key]
+		if !ok {
+			return L.RaiseError(fmt.Errorf("no field '%s' in %s", key, t))
+		}
+		fv, _ := fieldByIndex(obj.Elem(), f.index, true)
+		if !fv.IsValid() {
+			return L.RaiseError(fmt.Errorf("field '%s' of %s cannot be set", key, t))
+		}
+		if err := L.To(3, fv.Addr().Interface()); err != nil {
+			return L.RaiseError(err)
+		}
+		return 0
+	})
+	l.SetField(-2, "__newindex")
+	l.PushFunction(func(L *LuaState) int {
+		a, _ := L.toObject(1)
+		b, _ := L.toObject(2)
+		L.PushBoolean(a.IsValid() && b.IsValid() && a.Pointer() == b.Pointer() && a.Type() == b.Type())
+		return 1
+	})
+	l.SetField(-2, "__eq")
+	l.PushFunction(func(L *LuaState) int {
+		obj, _ := L.toObject(1)
+		L.PushString(fmt.Sprintf("%s: %p", t, obj.Interface()))
+		return 1
+	})
+	l.SetField(-2, "__tostring")
+	return ot
+}
+
+// pushField pushes the value of a field read from an object.
+func (l *LuaState) pushField(fv reflect.Value) int {
+	switch {
+	case fv.Kind() == reflect.Struct:
+		l.pushObject(fv.Addr())
+	case fv.Kind() == reflect.Pointer && fv.Type().Elem().Kind() == reflect.Struct:
+		l.pushObject(fv)
+	default:
+		if err := l.Push(fv.Interface()); err != nil {
+			return l.RaiseError(err)
+		}
+	}
+	return 1
+}
+
+// pushMethod pushes the Go function calling fn, a method of the pointer type
+// t or a function taking it first, on the object passed first.
+func (l *LuaState) pushMethod(t reflect.Type, fn reflect.Value) {
+	withState := fn.Type().NumIn() > 1 && fn.Type().In(1) == luaStateType
+	l.PushFunction(func(L *LuaState) int {
+		obj, err := L.checkObject(1, t)
+		if err != nil {
+			return L.RaiseError(err)
+		}
+		in := []reflect.Value{obj}
+		if withState {
+			in = append(in, reflect.ValueOf(L))
+		}
+		return L.callGoFunc(fn, in, 2)
+	})
+}
+
+// checkObject returns the Go pointer of the object of pointer type t at arg,
+// or the argument error for it.
+func (l *LuaState) checkObject(arg int, t reflect.Type) (reflect.Value, error) {
+	if v, ok := l.toObject(arg); ok && v.Type() == t {
+		return v, nil
+	}
+	msg := fmt.Sprintf("%s expected, got %s", t, l.argTypeName(arg))
+	return reflect.Value{}, l.argError(arg, msg, nil)
+}
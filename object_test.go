@@ -0,0 +1,131 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type player struct {
+	Name string
+	HP   int
+	Pos  point
+	said []string
+}
+
+func (p *player) Say(msg string) string {
+	p.said = append(p.said, msg)
+	return p.Name + ": " + msg
+}
+
+func (p *player) Hit(L *LuaState, n int) error {
+	if n < 0 {
+		return fmt.Errorf("negative hit %d", n)
+	}
+	p.HP -= n
+	return nil
+}
+
+func TestPushObject(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	p := &player{Name: "ann", HP: 10, Pos: point{1, 2}}
+	L.PushObject(p)
+	L.SetGlobal("p")
+	L.RegisterGoFunc("same", func(a, b *player) bool { return a == b })
+	L.RegisterGoFunc("copy", func(v player) string { return v.Name })
+	if err := L.DoStringErr(`
+		assert(p.Name == "ann" and p.HP == 10 and p.missing == nil)
+		p.HP = p.HP - 1
+		assert(p:Say("ouch") == "ann: ouch")
+		p:Hit(4)
+		p.Pos.X = 5
+		assert(p.Pos.Y == 2)
+		assert(same(p, p) and p == p and copy(p) == "ann")
+		assert(tostring(p):find("player"))`); err != nil {
+		t.Fatal(err)
+	}
+	if p.HP != 5 || p.Pos.X != 5 || len(p.said) != 1 {
+		t.Errorf("player = %+v", p)
+	}
+	L.GetGlobal("p")
+	if L.ToObject(-1) != p {
+		t.Error("ToObject returned another pointer")
+	}
+	var q *player
+	if err := L.To(-1, &q); err != nil || q != p {
+		t.Errorf("To = %p, %v", q, err)
+	}
+	L.Pop(1)
+
+	L.PushObject((*player)(nil))
+	if !L.IsNil(-1) {
+		t.Error("a nil pointer did not push nil")
+	}
+	L.Pop(1)
+	L.PushObject(nil)
+	if !L.IsNil(-1) {
+		t.Error("nil did not push nil")
+	}
+	L.Pop(1)
+	defer func() {
+		if recover() == nil {
+			t.Error("PushObject of a non pointer did not panic")
+		}
+	}()
+	L.PushObject(*p)
+}
+
+func TestPushObjectErrors(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.PushObject(&player{Name: "bob"})
+	L.SetGlobal("p")
+	L.PushObject(&point{})
+	L.SetGlobal("pt")
+	for _, c := range []struct{ src, msg string }{
+		{`p.Nope = 1`, "no field 'Nope' in *lua.player"},
+		{`p.HP = "x"`, "cannot store string"},
+		{`p:Hit(-1)`, "negative hit -1"},
+		{`p:Hit("x")`, "bad argument #1 to 'Hit' (number expected, got string)"},
+		{`p.Say(pt, "x")`, "bad argument #1 to 'Say' (*lua.player expected, got userdata)"},
+		{`({Say = p.Say}):Say("x")`, "calling 'Say' on bad self (*lua.player expected, got table)"},
+	} {
+		err := L.DoStringErr(c.src)
+		if err == nil || !strings.Contains(err.Error(), c.msg) {
+			t.Errorf("%s: got %v, want %q", c.src, err, c.msg)
+		}
+	}
+	err := L.DoStringErr(`p:Hit(-1)`)
+	var le *LuaError
+	if !errors.As(err, &le) || le.Cause == nil {
+		t.Errorf("got %v, want the error of Hit as the cause", err)
+	}
+}
+
+func TestObjectCollected(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	for i := 0; i < 100; i++ {
+		L.PushObject(&player{})
+		L.Pop(1)
+	}
+	L.GCCollect()
+	if n := len(L.objects); n != 0 {
+		t.Errorf("%d objects left after collection", n)
+	}
+
+	// The __gc of objects ignores other values
+	L.PushObject(&player{Name: "ann"})
+	L.SetGlobal("p")
+	if err := L.DoStringErr(`
+		local gc = debug.getmetatable(p).__gc
+		gc(1) gc({}) gc(io.stdout) gc()
+		assert(p.Name == "ann")`); err != nil {
+		t.Error(err)
+	}
+	if n := len(L.objects); n != 1 {
+		t.Errorf("%d objects left, want 1", n)
+	}
+}
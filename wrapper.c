@@ -0,0 +1,268 @@
+/*
+** C side of the Go wrapper, see wrapper.go
+**
+** Go functions must never be unwound by a longjmp, so anything that can
+** raise an error (lua_error, luaL_error, ...) on behalf of Go is done here,
+** after the Go function has returned.
+*/
+
+#include <stdlib.h>
+
+#include "wrapper.h"
+#include "lstate.h"
+#include "ldo.h"
+#include "lgc.h"
+#include "_cgo_export.h"
+
+static void golua_enter(lua_State *L);
+static void golua_leave(lua_State *L);
+
+/*
+** Carry out the action a Go function asked for once it has returned.
+*/
+static int golua_finish(lua_State *L, int action, golua_Action *a) {
+  switch (action) {
+    case GOLUA_ERROR:
+      return lua_error(L);
+    case GOLUA_YIELD:
+      return lua_yieldk(L, a->nresults, a->ctx,
+                        a->ctx != 0 ? golua_continue : NULL);
+    case GOLUA_PCALLK:
+      return golua_continue(L, lua_pcallk(L, a->nargs, a->nresults,
+                            a->errfunc, a->ctx, golua_continue), a->ctx);
+    case GOLUA_CALLK:
+      lua_callk(L, a->nargs, a->nresults, a->ctx, golua_continue);
+      return golua_continue(L, LUA_OK, a->ctx);
+    default:
+      return a->nresults;
+  }
+}
+
+/*
+** Entry point for every Go function pushed with PushFunction.
+*/
+int golua_callback(lua_State *L) {
+  golua_Action a = {GOLUA_RETURN, 0, 0, 0, 0};
+  int action;
+  golua_enter(L);
+  action = cclosure_callback(L, clCvalue(s2v(L->ci->func)), &a);
+  golua_leave(L);
+  return golua_finish(L, action, &a);
+}
+
+/*
+** Continuation of a Go function, 'ctx' is the id of the Go continuation.
+*/
+int golua_continue(lua_State *L, int status, lua_KContext ctx) {
+  golua_Action a = {GOLUA_RETURN, 0, 0, 0, 0};
+  int action;
+  golua_enter(L);
+  action = continue_callback(L, status, ctx, &a);
+  golua_leave(L);
+  return golua_finish(L, action, &a);
+}
+
+/*
+** Hook of every thread with a Go hook set by SetHook.
+*/
+void golua_hook(lua_State *L, lua_Debug *ar) {
+  int action;
+  golua_enter(L);
+  action = hook_callback(L, ar);
+  golua_leave(L);
+  if (action == GOLUA_ERROR)
+    lua_error(L);
+}
+
+/*
+** Message handler of CallSafeErr, the one of lua.c once Go has saved the
+** original error value. Go errors get a traceback too.
+*/
+int golua_msghandler(lua_State *L) {
+  const char *msg;
+  int goerror;
+  golua_enter(L);
+  goerror = error_handled(L);
+  golua_leave(L);
+  msg = lua_tostring(L, 1);
+  if (msg == NULL) {  /* is error object not a string? */
+    if (luaL_callmeta(L, 1, "__tostring") &&  /* does it have a metamethod */
+        lua_type(L, -1) == LUA_TSTRING) {  /* that produces a string? */
+      if (!goerror)
+        return 1;  /* that is the message */
+      msg = lua_tostring(L, -1);
+    }
+    else
+      msg = lua_pushfstring(L, "(error object is a %s value)",
+                               luaL_typename(L, 1));
+  }
+  luaL_traceback(L, L, msg, 1);  /* append a standard traceback */
+  return 1;  /* return the traceback */
+}
+
+/*
+** Called through luai_userstatefree (see luaconf.h) before the thread L1 is
+** freed, so that its Go hook is not found for a thread reusing its address.
+*/
+void golua_userstatefree(lua_State *L, lua_State *L1) {
+  (void)L;
+  if (golua_getstate(L1)->hooks > 0)
+    thread_freed(L1);
+}
+
+/*
+** Called through luai_userstateresume (see luaconf.h) before the coroutine L
+** runs, so that a coroutine without a Go hook of its own runs the hook of the
+** calls in progress, limits included. Hooks set from Lua are left alone.
+*/
+void golua_userstateresume(lua_State *L, int n) {
+  (void)n;
+  if (L->hook == golua_hook || (L->hook == NULL && golua_getstate(L)->hooks > 0))
+    thread_resumed(L);
+}
+
+/*
+** lua_gettable called in protected mode by the Field helpers.
+*/
+int golua_gettable(lua_State *L) {
+  lua_gettable(L, 1);
+  return 1;
+}
+
+/*
+** Instructions run since the last count event of L, lua_sethook restarts
+** the count.
+*/
+int golua_hookelapsed(lua_State *L) {
+  if (!(L->hookmask & LUA_MASKCOUNT))
+    return 0;
+  return L->basehookcount - L->hookcount;
+}
+
+/*
+** Allocator counting the bytes in use, it fails the allocations that would
+** go over the limit so that Lua raises a memory error.
+*/
+static void *golua_alloc(void *ud, void *ptr, size_t osize, size_t nsize) {
+  golua_Alloc *a = (golua_Alloc *)ud;
+  void *nptr;
+  if (ptr == NULL)
+    osize = 0;  /* 'osize' is the type of the object being created */
+  if (nsize == 0) {
+    free(ptr);
+    a->used -= osize;
+    return NULL;
+  }
+  if (a->limit != 0 && a->unlimited == 0 && nsize > osize &&
+      a->used + (nsize - osize) > a->limit)
+    return NULL;
+  nptr = realloc(ptr, nsize);
+  if (nptr == NULL)
+    return NULL;
+  a->used = a->used - osize + nsize;
+  if (a->used > a->peak)
+    a->peak = a->used;
+  return nptr;
+}
+
+/*
+** Accounting of L, NULL when it does not use golua_alloc.
+*/
+static golua_Alloc *golua_getalloc(lua_State *L) {
+  void *ud;
+  return lua_getallocf(L, &ud) == golua_alloc ? (golua_Alloc *)ud : NULL;
+}
+
+/*
+** Go runs with the memory limit lifted: a failed allocation in a Lua API
+** call made from Go would raise the memory error across the Go frames.
+** golua_leave checks the limit again once back in C, after a collection
+** like the one Lua makes when an allocation fails.
+*/
+static void golua_enter(lua_State *L) {
+  golua_Alloc *a = golua_getalloc(L);
+  if (a != NULL)
+    a->unlimited++;
+}
+
+static void golua_leave(lua_State *L) {
+  golua_Alloc *a = golua_getalloc(L);
+  if (a == NULL || --a->unlimited > 0)
+    return;
+  if (a->limit != 0 && a->used > a->limit) {
+    if (!G(L)->gcstopem)
+      luaC_fullgc(L, 1);
+    if (a->used > a->limit)
+      luaD_throw(L, LUA_ERRMEM);
+  }
+}
+
+/*
+** Install the accounting allocator, starting from the memory already
+** allocated by luaL_newstate with the same realloc and free.
+*/
+void golua_setalloc(lua_State *L, golua_Alloc *a) {
+  a->used = (size_t)lua_gc(L, LUA_GCCOUNT) * 1024 + lua_gc(L, LUA_GCCOUNTB);
+  a->peak = a->used;
+  lua_setallocf(L, golua_alloc, a);
+}
+
+/*
+** lua_gc is variadic, which cgo cannot call, pass it the arguments 'what'
+** takes.
+*/
+int golua_gc(lua_State *L, int what, int a, int b, int c) {
+  switch (what) {
+    case LUA_GCSTEP: case LUA_GCSETPAUSE: case LUA_GCSETSTEPMUL:
+      return lua_gc(L, what, a);
+    case LUA_GCGEN:
+      return lua_gc(L, what, a, b);
+    case LUA_GCINC:
+      return lua_gc(L, what, a, b, c);
+    default:
+      return lua_gc(L, what);
+  }
+}
+
+/*
+** Dump the function on top of the stack to the Go writer with handle 'w'.
+*/
+static int golua_writer(lua_State *L, const void *p, size_t sz, void *ud) {
+  (void)L;
+  return dump_writer((void *)p, sz, (uintptr_t)ud);
+}
+
+int golua_dump(lua_State *L, uintptr_t w, int strip) {
+  return lua_dump(L, golua_writer, (void *)w, strip);
+}
+
+/*
+** Load a chunk read from the Go reader with handle 'r'.
+*/
+typedef struct golua_Reader {
+  uintptr_t r;
+  char buff[4096];
+} golua_Reader;
+
+static const char *golua_reader(lua_State *L, void *ud, size_t *size) {
+  golua_Reader *gr = (golua_Reader *)ud;
+  (void)L;
+  *size = load_reader(gr->r, gr->buff, sizeof(gr->buff));
+  return *size > 0 ? gr->buff : NULL;
+}
+
+int golua_load(lua_State *L, uintptr_t r, const char *chunkname,
+               const char *mode) {
+  golua_Reader gr;
+  gr.r = r;
+  return lua_load(L, golua_reader, &gr, chunkname, mode);
+}
+
+/* State of the Go wrapper, kept in the extra space of the main thread */
+void golua_setstate(lua_State *L, golua_State *s) {
+  *(golua_State **)lua_getextraspace(L) = s;
+}
+
+golua_State *golua_getstate(lua_State *L) {
+  return *(golua_State **)lua_getextraspace(L);
+}
@@ -10,18 +10,25 @@ package lua
 #include "lua.h"
 #include "lualib.h"
 #include "lauxlib.h"
+#include "wrapper.h"
 extern int panic_callback(lua_State* L);
-extern int pcallk_callback(lua_State* L, int status, lua_KContext ctx);
-extern int cclosure_callback(lua_State* L);
-extern int print_stack(lua_State* lua);
+extern int closure_gc(lua_State* L);
+extern int error_gc(lua_State* L);
+extern int continuation_gc(lua_State* L);
 */
 import "C"
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
 	"os"
+	"reflect"
+	"runtime/cgo"
+	"runtime/debug"
 	"unsafe"
 )
 
@@ -31,6 +38,17 @@ const (
 	LUA_ERRMEM          = 4
 	LUA_ERRRUN          = 2
 	LUA_ERRSYNTAX       = 3
+	LUA_GCCOLLECT       = 2
+	LUA_GCCOUNT         = 3
+	LUA_GCCOUNTB        = 4
+	LUA_GCGEN           = 10
+	LUA_GCINC           = 11
+	LUA_GCISRUNNING     = 9
+	LUA_GCRESTART       = 1
+	LUA_GCSETPAUSE      = 6
+	LUA_GCSETSTEPMUL    = 7
+	LUA_GCSTEP          = 5
+	LUA_GCSTOP          = 0
 	LUA_HOOKCALL        = 0
 	LUA_HOOKCOUNT       = 3
 	LUA_HOOKLINE        = 2
@@ -66,10 +84,12 @@ const (
 	LUA_OPUNM           = 12
 	LUA_PRELOAD_TABLE   = "_PRELOAD"
 	LUA_REFNIL          = -1
+	LUA_RELEASE         = "Lua 5.4.3"
 	LUAI_MAXSTACK       = 1000000
 	LUA_REGISTRYINDEX   = -LUAI_MAXSTACK - 1000
 	LUA_RIDX_GLOBALS    = 2
 	LUA_RIDX_MAINTHREAD = 1
+	LUA_SIGNATURE       = "\x1bLua"
 	LUA_TBOOLEAN        = 1
 	LUA_TFUNCTION       = 6
 	LUA_TLIGHTUSERDATA  = 2
@@ -90,41 +110,349 @@ const (
 type luaClosure struct {
 	id   int64
 	call func(L *LuaState) int
+	// The C closure pushed for call, the only one its id is valid in
+	self uintptr
 }
 
+// KFunction is a continuation of a Go function, called with the status and
+// the context given to YieldK when the coroutine is resumed. It returns like
+// a Go function called by Lua does.
+type KFunction func(L *LuaState, status int, ctx int) int
+
+type continuation struct {
+	ctx int
+	k   KFunction
+	// Stack index of the userdata releasing the continuation when it is
+	// collected, removed before k runs
+	anchor int
+}
+
+// Metatable of the userdata anchoring a continuation in the stack of the Go
+// function that registered it, its __gc releases the continuation when the
+// function is unwound by an error or its coroutine is collected
+const continuationMetaTable = "golua.continuation"
+
+// Results a Go function returns to ask golua_callback to raise the error
+// value on top of the stack, to yield or to call a function with a
+// continuation (see RaiseError, YieldK, PCallK and CallK)
+const (
+	raiseResult = -1
+	yieldResult = -2
+	callKResult = -3
+)
+
+// HookFunc is a debug hook set with SetHook.
+type HookFunc func(L *LuaState, ev DebugEvent)
+
+// DebugEvent describes the event a hook is called for.
+type DebugEvent struct {
+	// Event is one of LUA_HOOKCALL, LUA_HOOKRET, LUA_HOOKTAILCALL,
+	// LUA_HOOKLINE or LUA_HOOKCOUNT.
+	Event int
+	// CurrentLine is the line about to run for LUA_HOOKLINE events.
+	CurrentLine int
+	ar          *C.lua_Debug
+}
+
+// Info returns the activation record of the event, to be filled in with
+// GetInfo while the hook runs.
+func (ev DebugEvent) Info() *DebugInfo {
+	d := newDebugInfo()
+	// Only the fields set by Lua for the hook are copied, the others are not
+	// initialized until GetInfo asks for them
+	d.ar.event = ev.ar.event
+	d.ar.currentline = ev.ar.currentline
+	d.ar.i_ci = ev.ar.i_ci
+	d.Event = ev.Event
+	d.CurrentLine = ev.CurrentLine
+	return d
+}
+
+// DebugInfo is an activation record returned by GetStack, the fields are set
+// by GetInfo according to the options asked for.
+type DebugInfo struct {
+	Event           int
+	Name            string // (n)
+	NameWhat        string // (n) "global", "local", "field", "method"
+	What            string // (S) "Lua", "C", "main", "tail"
+	Source          string // (S)
+	ShortSrc        string // (S)
+	CurrentLine     int    // (l)
+	LineDefined     int    // (S)
+	LastLineDefined int    // (S)
+	NUps            int    // (u) number of upvalues
+	NParams         int    // (u) number of parameters
+	IsVararg        bool   // (u)
+	IsTailCall      bool   // (t)
+	FTransfer       int    // (r) index of first value transferred
+	NTransfer       int    // (r) number of transferred values
+	// Kept in its own allocation, cgo does not allow passing a pointer into
+	// a struct holding Go pointers
+	ar *C.lua_Debug
+}
+
+func newDebugInfo() *DebugInfo {
+	return &DebugInfo{ar: new(C.lua_Debug)}
+}
+
+// fill copies the fields lua_getinfo set for the options in what, the other
+// fields of ar may be left over from earlier calls and are not read.
+func (d *DebugInfo) fill(what string) {
+	d.Event = int(d.ar.event)
+	for _, o := range what {
+		switch o {
+		case 'n':
+			d.Name = goStringOrEmpty(d.ar.name)
+			d.NameWhat = goStringOrEmpty(d.ar.namewhat)
+		case 'S':
+			d.What = goStringOrEmpty(d.ar.what)
+			d.Source = ""
+			if d.ar.source != nil {
+				d.Source = C.GoStringN(d.ar.source, C.int(d.ar.srclen))
+			}
+			d.ShortSrc = C.GoString(&d.ar.short_src[0])
+			d.LineDefined = int(d.ar.linedefined)
+			d.LastLineDefined = int(d.ar.lastlinedefined)
+		case 'l':
+			d.CurrentLine = int(d.ar.currentline)
+		case 'u':
+			d.NUps = int(d.ar.nups)
+			d.NParams = int(d.ar.nparams)
+			d.IsVararg = d.ar.isvararg != 0
+		case 't':
+			d.IsTailCall = d.ar.istailcall != 0
+		case 'r':
+			d.FTransfer = int(d.ar.ftransfer)
+			d.NTransfer = int(d.ar.ntransfer)
+		}
+	}
+}
+
+func goStringOrEmpty(s *C.char) string {
+	if s == nil {
+		return ""
+	}
+	return C.GoString(s)
+}
+
+// luaHook is the hook of a thread, made of the Go hook set with SetHook and
+// the checks of the limits in progress (see limits.go), which run on count
+// events.
+type luaHook struct {
+	fn    HookFunc
+	mask  int
+	count int
+	// Context of the call made with a *Context function
+	ctx context.Context
+	// Instruction budget set with SetFuel or a *Fuel function
+	fuel *fuelMeter
+	// Instructions run toward the next count event of fn when the limits
+	// changed the interval
+	pending int
+}
+
+// Metatable of the userdata holding the closure id of a Go function, its
+// __gc releases the Go function once Lua has collected every copy of it
+const closureMetaTable = "golua.closure"
+
+// closureMetaTable for luaL_testudata, which checks it on every call
+var cClosureMetaTable = C.CString(closureMetaTable)
+
+// Metatable of the userdata raised by RaiseError, holding the id of the Go
+// error in the raised table
+const errorMetaTable = "golua.error"
+
+// raisedError is a Go error raised by RaiseError and the message scripts see.
+type raisedError struct {
+	err error
+	msg string
+}
+
+// LuaState wraps a lua_State, either the main thread created by NewLuaState
+// or one of its threads. Everything that is not per thread lives in the
+// globalState shared by all of them.
 type LuaState struct {
+	luaState *C.lua_State
+	*globalState
+}
+
+type globalState struct {
+	main *LuaState
+	// Handle to main, kept in C memory with the number of hooks in the
+	// extra space of every thread
+	handle    cgo.Handle
+	cstate    *C.golua_State
 	closureId int64
-	luaState  *C.lua_State
 	onPanic   func() int
-	onPCallK  func() int
 	closures  map[int64]luaClosure
+	// Continuations of yielded Go functions keyed by their lua_KContext
+	continuationId int64
+	continuations  map[int64]continuation
+	// Yield or call requested by the Go function that is returning
+	action C.golua_Action
+	// Go functions running on each thread, see inGoFunction
+	running map[*C.lua_State]int
+	// Hooks set with SetHook on each thread, until the thread is freed
+	hooks map[*C.lua_State]*luaHook
+	// Innermost thread with a hook that called into Lua from Go, its hook
+	// is run by the threads without one
+	entry *C.lua_State
+	// Original error value saved by the message handler of CallSafeErr
+	errValue    any
+	errValueSet bool
+	// Go cause of the error handled by the message handler of CallSafeErr
+	errCause error
+	// Errors raised by RaiseError keyed by the id their userdata holds
+	raisedId int64
+	raised   map[int64]raisedError
+	// Protected calls in progress and the Go panic recovered during them
+	pcallDepth int
+	panicked   *PanicError
+	repanic    bool
+	// Accounting of the allocator installed by NewLuaState, in C memory
+	alloc *C.golua_Alloc
+	// Cache of compiled chunks set with SetChunkCache
+	chunkCache *ChunkCache
+	// Naming of struct fields for Push and To
+	fieldNaming FieldNaming
+	// Go pointers of the objects pushed with PushObject keyed by the id
+	// their userdata holds, and the metatable of each pointer type
+	objectId    int64
+	objects     map[int64]reflect.Value
+	objectTypes map[reflect.Type]*objectType
+}
+
+// Option configures a state created by NewLuaState.
+type Option func(L *LuaState)
+
+// NewLuaState creates a state with the standard libraries opened. Its memory
+// is allocated by an accounting allocator, see MemoryUsage.
+func NewLuaState(opts ...Option) *LuaState {
+	alloc := (*C.golua_Alloc)(C.calloc(1, C.sizeof_golua_Alloc))
+	l := C.luaL_newstate()
+	C.golua_setalloc(l, alloc)
+	L := newState(l)
+	L.alloc = alloc
+	for _, opt := range opts {
+		opt(L)
+	}
+	L.OpenLibs()
+	return L
 }
 
-var luaMap = make(map[*C.lua_State]*LuaState)
+// newStateAlloc creates a state allocating its memory with f, like
+// lua_newstate. The standard libraries are not opened.
+func newStateAlloc(f C.lua_Alloc, ud unsafe.Pointer) *LuaState {
+	return newState(C.lua_newstate(f, ud))
+}
 
-func NewLuaState() *LuaState {
+func newState(l *C.lua_State) *LuaState {
 	L := &LuaState{
-		closureId: 0,
-		luaState:  C.luaL_newstate(),
-		onPanic:   nil,
-		onPCallK:  nil,
-		closures:  make(map[int64]luaClosure),
+		luaState: l,
+		globalState: &globalState{
+			closureId: 0,
+			onPanic:   nil,
+			closures:  make(map[int64]luaClosure),
+
+			continuations: make(map[int64]continuation),
+			raised:        make(map[int64]raisedError),
+			running:       make(map[*C.lua_State]int),
+			hooks:         make(map[*C.lua_State]*luaHook),
+			objects:       make(map[int64]reflect.Value),
+			objectTypes:   make(map[reflect.Type]*objectType),
+		},
 	}
-	L.OpenLibs()
-	luaMap[L.luaState] = L
-	C.lua_pushcclosure(L.luaState, (C.lua_CFunction)(C.cclosure_callback), 0)
-	L.SetGlobal("_____closure_fn")
+	L.main = L
+	L.handle = cgo.NewHandle(L)
+	L.cstate = (*C.golua_State)(C.calloc(1, C.sizeof_golua_State))
+	L.cstate.handle = C.uintptr_t(L.handle)
+	C.golua_setstate(L.luaState, L.cstate)
+	L.NewMetaTable(closureMetaTable)
+	L.PushCFunction((C.lua_CFunction)(C.closure_gc))
+	L.SetField(-2, "__gc")
+	L.PushBoolean(false)
+	L.SetField(-2, "__metatable")
+	L.Pop(1)
+	L.NewMetaTable(continuationMetaTable)
+	L.PushCFunction((C.lua_CFunction)(C.continuation_gc))
+	L.SetField(-2, "__gc")
+	L.PushBoolean(false)
+	L.SetField(-2, "__metatable")
+	L.Pop(1)
+	L.NewMetaTable(errorMetaTable)
+	L.PushCFunction((C.lua_CFunction)(C.error_gc))
+	L.SetField(-2, "__gc")
+	L.PushFunction(func(L *LuaState) int {
+		e, _ := L.goError(1)
+		L.PushString(e.msg)
+		return 1
+	})
+	L.SetField(-2, "__tostring")
+	L.PushBoolean(false)
+	L.SetField(-2, "__metatable")
+	L.Pop(1)
 	return L
 }
 
+// stateOf returns the LuaState for l, which may be the main thread of a state
+// created by NewLuaState or any thread of it. Threads inherit the extra space
+// of the main thread, so the handle stored there is found from all of them.
+func stateOf(l *C.lua_State) *LuaState {
+	main := cgo.Handle(C.golua_getstate(l).handle).Value().(*LuaState)
+	if main.luaState == l {
+		return main
+	}
+	return &LuaState{luaState: l, globalState: main.globalState}
+}
+
+// Close closes the state and all of its threads and releases every Go value
+// associated with it. It may be called on any thread of the state.
 func (l *LuaState) Close() {
-	C.lua_close(l.luaState)
+	main := l.main
+	if main.luaState == nil {
+		return
+	}
+	C.lua_close(main.luaState)
+	main.luaState = nil
+	main.handle.Delete()
+	C.free(unsafe.Pointer(main.cstate))
+	main.cstate = nil
+	if main.alloc != nil {
+		C.free(unsafe.Pointer(main.alloc))
+		main.alloc = nil
+	}
+	main.globalState.closures = nil
+	main.globalState.continuations = nil
+	main.globalState.running = nil
+	main.globalState.hooks = nil
+	main.globalState.objects = nil
+	main.globalState.objectTypes = nil
+	main.globalState.errValue = nil
+	main.globalState.errCause = nil
+	main.globalState.raised = nil
+	main.globalState.panicked = nil
+	main.globalState.onPanic = nil
 }
 
 func (l *LuaState) Call(nargs, nresults int) {
 	C.lua_callk(l.luaState, C.int(nargs), C.int(nresults), 0, nil)
 }
 
+// CallK is Call with a continuation, see PCallK. The function runs
+// unprotected, so k is always called with LUA_OK.
+func (l *LuaState) CallK(nargs, nresults, ctx int, k KFunction) int {
+	if k == nil {
+		l.Call(nargs, nresults)
+		return LUA_OK
+	}
+	if !l.inGoFunction() {
+		l.Call(nargs, nresults)
+		return k(l, LUA_OK, ctx)
+	}
+	l.deferCall(C.GOLUA_CALLK, nargs, nresults, 0, ctx, k)
+	return callKResult
+}
+
 func (l *LuaState) AbsIndex(idx int) int {
 	return int(C.lua_absindex(l.luaState, C.int(idx)))
 }
@@ -135,7 +463,7 @@ func (l *LuaState) Arith(op int) {
 
 //export panic_callback
 func panic_callback(l *C.lua_State) C.int {
-	L := luaMap[l]
+	L := stateOf(l)
 	if L.onPanic != nil {
 		return C.int(L.onPanic())
 	}
@@ -148,7 +476,7 @@ func (l *LuaState) AtPanic(onPanic func() int) {
 }
 
 func (l *LuaState) CheckStack(n int) bool {
-	return C.lua_checkstack(l.luaState, C.int(n)) == LUA_OK
+	return C.lua_checkstack(l.luaState, C.int(n)) != 0
 }
 
 func (l *LuaState) CloseSlot(idx int) {
@@ -156,7 +484,7 @@ func (l *LuaState) CloseSlot(idx int) {
 }
 
 func (l *LuaState) Compare(idx1, idx2 int, op int) bool {
-	return C.lua_compare(l.luaState, C.int(idx1), C.int(idx2), C.int(op)) == LUA_OK
+	return C.lua_compare(l.luaState, C.int(idx1), C.int(idx2), C.int(op)) != 0
 }
 
 func (l *LuaState) Concat(n int) {
@@ -171,33 +499,189 @@ func (l *LuaState) CreateTable(nArr, nRec int) {
 	C.lua_createtable(l.luaState, C.int(nArr), C.int(nRec))
 }
 
-func (l *LuaState) Dump(writer func([]byte) int) int {
-	// TODO:
+// dumpWriter is the io.Writer of a Dump in progress and its first error.
+type dumpWriter struct {
+	w   io.Writer
+	err error
+}
+
+// Dump writes the Lua function on top of the stack to w as a binary chunk,
+// which Load and LoadBuffer accept. strip leaves out the debug information.
+// The function is not popped. The error is the first one returned by w, or a
+// *PanicError when w panics.
+func (l *LuaState) Dump(w io.Writer, strip bool) error {
+	if !l.IsFunction(-1) || l.IsCFunction(-1) {
+		return errors.New("lua: Dump needs a Lua function on top of the stack")
+	}
+	d := &dumpWriter{w: w}
+	h := cgo.NewHandle(d)
+	defer h.Delete()
+	var s C.int
+	if strip {
+		s = 1
+	}
+	status := C.golua_dump(l.luaState, C.uintptr_t(h), s)
+	if d.err != nil {
+		return d.err
+	}
+	if status != 0 {
+		return fmt.Errorf("lua: dump failed with status %d", int(status))
+	}
+	return nil
+}
+
+// dump_writer writes a piece of the chunk dumped by golua_dump, a non zero
+// result stops the dump. A panic of the writer must not unwind through
+// lua_dump, it stops the dump instead.
+//
+//export dump_writer
+func dump_writer(p unsafe.Pointer, sz C.size_t, h C.uintptr_t) (stop C.int) {
+	d := cgo.Handle(h).Value().(*dumpWriter)
+	defer func() {
+		if r := recover(); r != nil {
+			d.err = &PanicError{Value: r, Stack: debug.Stack()}
+			stop = 1
+		}
+	}()
+	if _, err := d.w.Write(C.GoBytes(p, C.int(sz))); err != nil {
+		d.err = err
+		return 1
+	}
 	return 0
 }
 
+// Error raises the value on top of the stack as a Lua error. It never
+// returns and must not be called from a Go function called by Lua, use
+// RaiseError there instead.
 func (l *LuaState) Error() int {
 	return int(C.lua_error(l.luaState))
 }
 
+// RaiseError raises err as a Lua error from a Go function called by Lua. The
+// message is prefixed with the position of the calling Lua code, like
+// luaL_error does. It must be used as the return value of the Go function:
+//
+//	return L.RaiseError(err)
+//
+// The error is raised once the Go function has returned to C, so the longjmp
+// never crosses Go frames. The error value is a userdata holding err, which
+// tostring turns into the message. A *LuaError caught on the Go side for it
+// unwraps to err, also when a script caught the error with pcall and raised
+// the same value again with error.
+func (l *LuaState) RaiseError(err error) int {
+	return l.raise(err, err.Error())
+}
+
+func (l *LuaState) raise(err error, msg string) int {
+	C.luaL_where(l.luaState, 1)
+	msg = l.ToString(-1) + msg
+	l.Pop(1)
+	l.raisedId++
+	l.raised[l.raisedId] = raisedError{err: err, msg: msg}
+	*(*int64)(l.NewUserDataUV(8, 0)) = l.raisedId
+	l.SetLMetaTable(errorMetaTable)
+	return -1
+}
+
+// goError returns the error raised by RaiseError at idx, if the value at idx
+// is one.
+func (l *LuaState) goError(idx int) (raisedError, bool) {
+	id := (*int64)(l.TestUData(idx, errorMetaTable))
+	if id == nil {
+		return raisedError{}, false
+	}
+	e, ok := l.raised[*id]
+	return e, ok
+}
+
+//export error_gc
+func error_gc(l *C.lua_State) C.int {
+	L := stateOf(l)
+	// Scripts can reach __gc with debug.getmetatable and pass it anything
+	if id := (*int64)(L.TestUData(1, errorMetaTable)); id != nil {
+		delete(L.raised, *id)
+	}
+	return 0
+}
+
+// GC calls lua_gc with the option what and its arguments in data, see the
+// GC* methods for each option.
 func (l *LuaState) GC(what int, data ...int) int {
-	panic("not implemented, variadic function, use directly")
+	var args [3]C.int
+	for i := 0; i < len(data) && i < len(args); i++ {
+		args[i] = C.int(data[i])
+	}
+	return int(C.golua_gc(l.luaState, C.int(what), args[0], args[1], args[2]))
 }
 
-func (l *LuaState) GetAllocF(ud *unsafe.Pointer) {
-	//C.lua_getallocf(l.luaState, ud)
-	panic("not implemented")
+// GCCollect performs a full garbage collection cycle.
+func (l *LuaState) GCCollect() {
+	l.GC(LUA_GCCOLLECT)
+}
+
+// GCStop stops the garbage collector, only explicit collections and steps
+// run until GCRestart is called.
+func (l *LuaState) GCStop() {
+	l.GC(LUA_GCSTOP)
+}
+
+// GCRestart restarts the garbage collector stopped by GCStop.
+func (l *LuaState) GCRestart() {
+	l.GC(LUA_GCRESTART)
+}
+
+// GCIsRunning reports whether the garbage collector is running, that is not
+// stopped.
+func (l *LuaState) GCIsRunning() bool {
+	return l.GC(LUA_GCISRUNNING) != 0
+}
+
+// GCStep performs a step of garbage collection, as if kbytes were allocated,
+// or a basic step when kbytes is 0. It returns true when the step finished a
+// cycle.
+func (l *LuaState) GCStep(kbytes int) bool {
+	return l.GC(LUA_GCSTEP, kbytes) != 0
+}
+
+// GCCount returns the bytes of memory in use by Lua.
+func (l *LuaState) GCCount() int {
+	return l.GC(LUA_GCCOUNT)*1024 + l.GC(LUA_GCCOUNTB)
+}
+
+// GCIncremental switches the collector to incremental mode and returns the
+// previous mode, LUA_GCGEN or LUA_GCINC. pause and stepmul are percentages,
+// stepsize is the log2 of the step size in bytes; 0 keeps the current value.
+func (l *LuaState) GCIncremental(pause, stepmul, stepsize int) int {
+	return l.GC(LUA_GCINC, pause, stepmul, stepsize)
+}
+
+// GCGenerational switches the collector to generational mode and returns the
+// previous mode, LUA_GCGEN or LUA_GCINC. minormul and majormul are
+// percentages, 0 keeps the current value.
+func (l *LuaState) GCGenerational(minormul, majormul int) int {
+	return l.GC(LUA_GCGEN, minormul, majormul)
+}
+
+// getAllocF returns the allocator of the state and stores its opaque pointer
+// in ud when it is not nil.
+func (l *LuaState) getAllocF(ud *unsafe.Pointer) C.lua_Alloc {
+	var p unsafe.Pointer
+	f := C.lua_getallocf(l.luaState, &p)
+	if ud != nil {
+		*ud = p
+	}
+	return f
 }
 
 func (l *LuaState) GetExtraSpace() {
-	//C.lua_getextraspace(l.luaState)
-	panic("not implemented")
+	// The extra space holds the handle used to find the LuaState from C
+	panic("not available, used by the wrapper")
 }
 
 func (l *LuaState) GetField(idx int, k string) bool {
 	cs := C.CString(k)
 	defer C.free(unsafe.Pointer(cs))
-	return C.lua_getfield(l.luaState, C.int(idx), cs) == LUA_OK
+	return C.lua_getfield(l.luaState, C.int(idx), cs) != LUA_TNIL
 }
 
 func (l *LuaState) GetGlobal(name string) {
@@ -206,9 +690,12 @@ func (l *LuaState) GetGlobal(name string) {
 	C.lua_getglobal(l.luaState, cs)
 }
 
-func (l *LuaState) Gethook() {
-	//C.lua_gethook(l.luaState)
-	panic("not implemented")
+// GetHook returns the hook set with SetHook on l, or nil.
+func (l *LuaState) GetHook() HookFunc {
+	if h, ok := l.hooks[l.luaState]; ok {
+		return h.fn
+	}
+	return nil
 }
 
 func (l *LuaState) GetHookCount() int {
@@ -223,27 +710,51 @@ func (l *LuaState) GetI(idx int, n int64) int {
 	return int(C.lua_geti(l.luaState, C.int(idx), C.lua_Integer(n)))
 }
 
-func (l *LuaState) GetInfo() {
-	//C.lua_getinfo(l.luaState)
-	panic("not implemented, debug stuff")
+// GetInfo fills ar with the information selected by what, see lua_getinfo.
+// When what starts with '>' the function on top of the stack is described
+// and popped, ar may then be a zero DebugInfo.
+func (l *LuaState) GetInfo(what string, ar *DebugInfo) bool {
+	cs := C.CString(what)
+	defer C.free(unsafe.Pointer(cs))
+	if ar.ar == nil {
+		ar.ar = new(C.lua_Debug)
+	}
+	if C.lua_getinfo(l.luaState, cs, ar.ar) == 0 {
+		return false
+	}
+	ar.fill(what)
+	return true
 }
 
 func (l *LuaState) GetIUserValue(idx, n int) int {
 	return int(C.lua_getiuservalue(l.luaState, C.int(idx), C.int(n)))
 }
 
-func (l *LuaState) GetLocal() {
-	//C.lua_getlocal(l.luaState)
-	panic("not implemented, debug stuff")
+// GetLocal pushes the value of local n of the activation record ar and
+// returns its name, or returns "" and pushes nothing if there is no such
+// local. With a nil ar it returns the name of parameter n of the function on
+// top of the stack.
+func (l *LuaState) GetLocal(ar *DebugInfo, n int) string {
+	var car *C.lua_Debug
+	if ar != nil {
+		car = ar.ar
+	}
+	return goStringOrEmpty(C.lua_getlocal(l.luaState, car, C.int(n)))
 }
 
 func (l *LuaState) GetMetaTable(objindex int) int {
 	return int(C.lua_getmetatable(l.luaState, C.int(objindex)))
 }
 
-func (l *LuaState) GetStack() {
-	//C.lua_getstack(l.luaState)
-	panic("not implemented, debug stuff")
+// GetStack returns the activation record of the function running at level,
+// 0 being the current function. It returns false when level is greater than
+// the stack depth.
+func (l *LuaState) GetStack(level int) (*DebugInfo, bool) {
+	ar := newDebugInfo()
+	if C.lua_getstack(l.luaState, C.int(level), ar.ar) == 0 {
+		return nil, false
+	}
+	return ar, true
 }
 
 func (l *LuaState) GetTable(idx int) int {
@@ -267,7 +778,7 @@ func (l *LuaState) IsBoolean(n int) bool {
 }
 
 func (l *LuaState) IsCFunction(n int) bool {
-	return C.lua_iscfunction(l.luaState, C.int(n)) == LUA_OK
+	return C.lua_iscfunction(l.luaState, C.int(n)) != 0
 }
 
 func (l *LuaState) IsFunction(n int) bool {
@@ -275,7 +786,7 @@ func (l *LuaState) IsFunction(n int) bool {
 }
 
 func (l *LuaState) IsInteger(idx int) bool {
-	return C.lua_isinteger(l.luaState, C.int(idx)) == LUA_OK
+	return C.lua_isinteger(l.luaState, C.int(idx)) != 0
 }
 
 func (l *LuaState) IsLightUserData(n int) bool {
@@ -295,11 +806,11 @@ func (l *LuaState) IsNoneOrNil(n int) bool {
 }
 
 func (l *LuaState) IsNumber(idx int) bool {
-	return C.lua_isnumber(l.luaState, C.int(idx)) == LUA_OK
+	return C.lua_isnumber(l.luaState, C.int(idx)) != 0
 }
 
 func (l *LuaState) IsString(idx int) bool {
-	return C.lua_isstring(l.luaState, C.int(idx)) == LUA_OK
+	return C.lua_isstring(l.luaState, C.int(idx)) != 0
 }
 
 func (l *LuaState) IsTable(n int) bool {
@@ -311,25 +822,80 @@ func (l *LuaState) IsThread(n int) bool {
 }
 
 func (l *LuaState) IsUserData(idx int) bool {
-	return C.lua_isuserdata(l.luaState, C.int(idx)) == LUA_OK
+	return C.lua_isuserdata(l.luaState, C.int(idx)) != 0
 }
 
 func (l *LuaState) IsYieldable() bool {
-	return C.lua_isyieldable(l.luaState) == LUA_OK
+	return C.lua_isyieldable(l.luaState) != 0
 }
 
 func (l *LuaState) Len(idx int) {
 	C.lua_len(l.luaState, C.int(idx))
 }
 
-func (l *LuaState) Load() {
-	//C.lua_load(l.luaState)
-	panic("not implemented")
+// loadReader is the io.Reader of a Load in progress and its first error.
+type loadReader struct {
+	r   io.Reader
+	err error
 }
 
-func (l *LuaState) NewState() {
-	//C.lua_newstate(l.luaState)
-	panic("not implemented")
+// Load loads a chunk read from r, source or binary as allowed by mode ("b",
+// "t", "bt" or "" for both), and pushes it as a function. chunkName names
+// the chunk in error messages and debug information. On failure nothing is
+// pushed and the error is a *LuaError, the error returned by r or a
+// *PanicError when r panics.
+func (l *LuaState) Load(r io.Reader, chunkName, mode string) error {
+	var cn, cm *C.char
+	if len(chunkName) > 0 {
+		cn = C.CString(chunkName)
+		defer C.free(unsafe.Pointer(cn))
+	}
+	if len(mode) > 0 {
+		cm = C.CString(mode)
+		defer C.free(unsafe.Pointer(cm))
+	}
+	lr := &loadReader{r: r}
+	h := cgo.NewHandle(lr)
+	defer h.Delete()
+	status := int(C.golua_load(l.luaState, C.uintptr_t(h), cn, cm))
+	if lr.err != nil {
+		// The chunk was cut short, drop whatever Lua made of it
+		l.Pop(1)
+		return lr.err
+	}
+	if status != LUA_OK {
+		return l.popError(status)
+	}
+	return nil
+}
+
+// load_reader fills buf with the next piece of the chunk loaded by
+// golua_load and returns its size, 0 at the end of the chunk. A panic of the
+// reader must not unwind through lua_load, it ends the chunk instead.
+//
+//export load_reader
+func load_reader(h C.uintptr_t, buf *C.char, size C.size_t) (n C.size_t) {
+	lr := cgo.Handle(h).Value().(*loadReader)
+	defer func() {
+		if r := recover(); r != nil {
+			lr.err = &PanicError{Value: r, Stack: debug.Stack()}
+			n = 0
+		}
+	}()
+	p := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(size))
+	for {
+		n, err := lr.r.Read(p)
+		if n > 0 {
+			return C.size_t(n)
+		}
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			lr.err = err
+			return 0
+		}
+	}
 }
 
 func (l *LuaState) NewTable() {
@@ -338,7 +904,8 @@ func (l *LuaState) NewTable() {
 
 func (l *LuaState) NewThread() LuaState {
 	return LuaState{
-		luaState: C.lua_newthread(l.luaState),
+		luaState:    C.lua_newthread(l.luaState),
+		globalState: l.globalState,
 	}
 }
 
@@ -359,22 +926,111 @@ func (l *LuaState) NumberToInteger(n int64, p *int) bool {
 }
 
 func (l *LuaState) PCall(n, r, f int) bool {
-	return l.PCallK(n, r, f, 0, nil)
+	return l.pcallk(n, r, f) == LUA_OK
 }
 
-//export pcallk_callback
-func pcallk_callback(l *C.lua_State, status C.int, ctx C.lua_KContext) C.int {
-	L := luaMap[l]
-	if L.onPCallK != nil {
-		return C.int(L.onPCallK())
+// PCallErr is PCall returning a *LuaError built from the error value, which
+// is popped from the stack.
+func (l *LuaState) PCallErr(n, r, f int) error {
+	status := l.pcallk(n, r, f)
+	if status != LUA_OK {
+		return l.popError(status)
 	}
-	return 0
+	return nil
+}
+
+// PCallK calls a function in protected mode and continues in k, which
+// receives the call status and ctx and returns like a Go function called by
+// Lua. Each call registers its own continuation, which is released once it
+// has run or when the Go function is unwound without running it. With a nil
+// k it returns the status of the call.
+//
+// Inside a Go function called by Lua it must be used as the return value:
+//
+//	return L.PCallK(nargs, nresults, 0, ctx, k)
+//
+// The call is then made by the C trampoline, so the called function may
+// yield; k runs when the call returns or, after a yield, when the coroutine
+// is resumed. Elsewhere the call is made immediately and k is called with its
+// status before PCallK returns.
+func (l *LuaState) PCallK(nargs, nresults, errfunc, ctx int, k KFunction) int {
+	if k == nil {
+		return l.pcallk(nargs, nresults, errfunc)
+	}
+	if !l.inGoFunction() {
+		return k(l, l.pcallk(nargs, nresults, errfunc), ctx)
+	}
+	l.deferCall(C.GOLUA_PCALLK, nargs, nresults, errfunc, ctx, k)
+	return callKResult
+}
+
+// deferCall records a call with continuation for golua_finish to make once
+// the running Go function returns callKResult.
+func (l *LuaState) deferCall(action C.int, nargs, nresults, errfunc, ctx int, k KFunction) {
+	// The anchor of the continuation goes below the function
+	if errfunc < 0 {
+		errfunc = l.AbsIndex(errfunc)
+	}
+	kctx := l.newContinuation(ctx, k, nargs+1)
+	l.action = C.golua_Action{
+		what:     action,
+		nargs:    C.int(nargs),
+		nresults: C.int(nresults),
+		errfunc:  C.int(errfunc),
+		ctx:      kctx,
+	}
+}
+
+// inGoFunction reports whether a Go function called by Lua is running on l.
+func (l *LuaState) inGoFunction() bool {
+	return l.running[l.luaState] > 0
+}
+
+// pcallk is the single place lua_pcallk is called from.
+func (l *LuaState) pcallk(nargs, nresults, errfunc int) int {
+	return l.protected(func() C.int {
+		return C.lua_pcallk(l.luaState, C.int(nargs), C.int(nresults), C.int(errfunc), 0, nil)
+	})
+}
+
+// protected runs call, a lua_pcallk or lua_resume, tracking the depth of
+// protected calls so a Go panic recovered inside them can be re-raised once
+// the outermost one has returned (see SetRepanic). When l has a hook, the
+// coroutines resumed during the call run it (see inheritedHook).
+func (l *LuaState) protected(call func() C.int) int {
+	entry := l.entry
+	if _, ok := l.hooks[l.luaState]; ok {
+		l.entry = l.luaState
+	}
+	// Lua called from a Go function runs under the memory limit again
+	var unlimited C.int
+	if l.alloc != nil {
+		unlimited, l.alloc.unlimited = l.alloc.unlimited, 0
+	}
+	l.pcallDepth++
+	status := int(call())
+	l.pcallDepth--
+	l.entry = entry
+	if l.alloc != nil {
+		l.alloc.unlimited = unlimited
+	}
+	if l.pcallDepth == 0 && l.panicked != nil {
+		p := l.panicked
+		l.panicked = nil
+		if l.repanic {
+			panic(p)
+		}
+	}
+	return status
 }
 
-func (l *LuaState) PCallK(nargs, nresults, errfunc, ctx int, k func() int) bool {
-	l.onPCallK = k
-	return C.lua_pcallk(l.luaState, C.int(nargs), C.int(nresults), C.int(errfunc),
-		C.lua_KContext(ctx), (C.lua_KFunction)(C.pcallk_callback)) == LUA_OK
+// SetRepanic controls what happens to a panic recovered from a Go function
+// called by Lua. It is always turned into a Lua error so the C frames of the
+// call unwind normally, and when enable is true the *PanicError is panicked
+// again on the Go side once the outermost protected call returns, even if a
+// script caught the error with pcall.
+func (l *LuaState) SetRepanic(enable bool) {
+	l.repanic = enable
 }
 
 func (l *LuaState) Pop(n int) {
@@ -389,19 +1045,83 @@ func (l *LuaState) PushBoolean(b bool) {
 	}
 }
 
+// cclosure_callback runs the Go function for golua_callback and returns the
+// action golua_callback should take, its arguments are written to a.
+//
 //export cclosure_callback
-func cclosure_callback(l *C.lua_State) C.int {
-	L := luaMap[l]
-	closureId := L.ToInteger(1)
-	c, ok := L.closures[closureId]
-	if ok {
-		L.Remove(1)
-		return C.int(c.call(L))
-	} else {
-		return 0
+func cclosure_callback(l *C.lua_State, self unsafe.Pointer, a *C.golua_Action) C.int {
+	L := stateOf(l)
+	// debug.setupvalue lets scripts replace the upvalue with any value, or
+	// with the closure id of another Go function
+	closureId := (*int64)(C.luaL_testudata(l, C.int(L.UpValueIndex(1)), cClosureMetaTable))
+	if closureId == nil {
+		L.PushString("attempt to call a Go function without its closure id")
+		return C.GOLUA_ERROR
+	}
+	c, ok := L.closures[*closureId]
+	if !ok {
+		L.PushString("attempt to call a released Go function")
+		return C.GOLUA_ERROR
+	}
+	if c.self != uintptr(self) {
+		L.PushString("attempt to call a Go function with the closure id of another")
+		return C.GOLUA_ERROR
+	}
+	return L.finish(L.callGo(c.call), a)
+}
+
+// continue_callback runs the continuation registered under ctx by YieldK,
+// PCallK or CallK for golua_continue, it returns like cclosure_callback.
+//
+//export continue_callback
+func continue_callback(l *C.lua_State, status C.int, ctx C.lua_KContext, a *C.golua_Action) C.int {
+	L := stateOf(l)
+	c, ok := L.continuations[int64(ctx)]
+	if !ok {
+		L.PushString("attempt to resume a released Go continuation")
+		return C.GOLUA_ERROR
+	}
+	delete(L.continuations, int64(ctx))
+	L.Remove(c.anchor)
+	return L.finish(L.callGo(func(L *LuaState) int {
+		return c.k(L, int(status), c.ctx)
+	}), a)
+}
+
+// finish turns the result n of a Go function into the action golua_finish
+// should take.
+func (l *LuaState) finish(n int, a *C.golua_Action) C.int {
+	switch {
+	case n == yieldResult || n == callKResult:
+		*a = l.action
+		return a.what
+	case n < 0:
+		return C.GOLUA_ERROR
+	default:
+		a.nresults = C.int(n)
+		return C.GOLUA_RETURN
 	}
 }
 
+// callGo calls fn, converting a panic into a Lua error raised with the
+// panic value and the Go stack.
+func (l *LuaState) callGo(fn func(L *LuaState) int) (n int) {
+	l.running[l.luaState]++
+	defer func() {
+		if l.running[l.luaState]--; l.running[l.luaState] == 0 {
+			delete(l.running, l.luaState)
+		}
+		if r := recover(); r != nil {
+			p := &PanicError{Value: r, Stack: debug.Stack()}
+			if l.panicked == nil {
+				l.panicked = p
+			}
+			n = l.raise(p, fmt.Sprintf("%s\n%s", p, p.Stack))
+		}
+	}()
+	return fn(l)
+}
+
 func (l *LuaState) PushCClosure(fn C.lua_CFunction, n int) {
 	C.lua_pushcclosure(l.luaState, fn, C.int(n))
 }
@@ -410,15 +1130,51 @@ func (l *LuaState) PushCFunction(fn C.lua_CFunction) {
 	l.PushCClosure(fn, 0)
 }
 
+// PushFunction pushes a Go function as a C closure of golua_callback. Its
+// only upvalue is a userdata holding the id of fn in the closures table, fn
+// is released when that userdata is collected or by ReleaseFunction. The id
+// is only honoured in the closure it was pushed with.
 func (l *LuaState) PushFunction(fn func(L *LuaState) int) {
+	closureId := (*int64)(l.NewUserDataUV(8, 0))
+	*closureId = l.closureId
+	l.SetLMetaTable(closureMetaTable)
+	l.PushCClosure((C.lua_CFunction)(C.golua_callback), 1)
 	l.closures[l.closureId] = luaClosure{
 		id:   l.closureId,
 		call: fn,
+		self: uintptr(l.ToPointer(-1)),
 	}
-	l.DoString(fmt.Sprintf("return function(...) return _____closure_fn(%d, ...) end", l.closureId))
 	l.closureId++
 }
 
+// ReleaseFunction releases the Go function pushed with PushFunction at idx
+// without waiting for Lua to collect it. Calling it from Lua afterwards
+// raises an error. It returns false if idx is not such a function or it
+// was already released.
+func (l *LuaState) ReleaseFunction(idx int) bool {
+	if !l.IsCFunction(idx) || C.lua_getupvalue(l.luaState, C.int(idx), 1) == nil {
+		return false
+	}
+	defer l.Pop(1)
+	closureId := (*int64)(l.TestUData(-1, closureMetaTable))
+	if closureId == nil {
+		return false
+	}
+	_, ok := l.closures[*closureId]
+	delete(l.closures, *closureId)
+	return ok
+}
+
+//export closure_gc
+func closure_gc(l *C.lua_State) C.int {
+	L := stateOf(l)
+	// Scripts can reach __gc with debug.getmetatable and pass it anything
+	if id := (*int64)(C.luaL_testudata(l, 1, cClosureMetaTable)); id != nil {
+		delete(L.closures, *id)
+	}
+	return 0
+}
+
 func (l *LuaState) PushFString(fmt string, a ...any) {
 	//C.lua_pushfstring(l.luaState)
 	panic("not implemented")
@@ -448,10 +1204,23 @@ func (l *LuaState) PushLiteral(s string) {
 	l.PushString(s)
 }
 
+// PushBytes pushes the bytes of b as a Lua string, which may hold zeros.
+func (l *LuaState) PushBytes(b []byte) {
+	var p *C.char
+	if len(b) > 0 {
+		p = (*C.char)(unsafe.Pointer(&b[0]))
+	}
+	C.lua_pushlstring(l.luaState, p, C.size_t(len(b)))
+}
+
+// PushLString pushes s, which may hold zeros. Lua copies it, nothing is
+// allocated on the Go side.
 func (l *LuaState) PushLString(s string) {
-	cs := C.CString(s)
-	defer C.free(unsafe.Pointer(cs))
-	C.lua_pushlstring(l.luaState, cs, C.size_t(len(s)))
+	var p *C.char
+	if len(s) > 0 {
+		p = (*C.char)(unsafe.Pointer(unsafe.StringData(s)))
+	}
+	C.lua_pushlstring(l.luaState, p, C.size_t(len(s)))
 }
 
 func (l *LuaState) PushNil() {
@@ -466,10 +1235,10 @@ func (l *LuaState) PushFloat32(n float32) {
 	C.lua_pushnumber(l.luaState, C.double(n))
 }
 
+// PushString pushes s like PushLString and returns it.
 func (l *LuaState) PushString(s string) string {
-	cs := C.CString(s)
-	defer C.free(unsafe.Pointer(cs))
-	return C.GoString(C.lua_pushstring(l.luaState, cs))
+	l.PushLString(s)
+	return s
 }
 
 func (l *LuaState) PushThread() int {
@@ -536,21 +1305,52 @@ func (l *LuaState) ResetThread() int {
 	return int(C.lua_resetthread(l.luaState))
 }
 
+// Resume starts or resumes the coroutine l with narg arguments on its stack.
+// It returns LUA_YIELD when the coroutine yields, LUA_OK when it finishes or
+// an error status, nres receives the number of values yielded or returned.
 func (l *LuaState) Resume(from LuaState, narg int, nres *int) int {
-	// TODO:  Review this
 	ci := C.int(0)
-	res := int(C.lua_resume(l.luaState, from.luaState, C.int(narg), &ci))
+	res := l.protected(func() C.int {
+		return C.lua_resume(l.luaState, from.luaState, C.int(narg), &ci)
+	})
 	*nres = int(ci)
 	return res
 }
 
+// ResumeErr is Resume reporting the three outcomes separately: yielded is
+// true when the coroutine yielded nresults values, otherwise it finished
+// returning nresults values or failed with err. The values are left on top of
+// the stack of l. On failure the error value is popped and err is a
+// *LuaError with the traceback of the dead coroutine.
+func (l *LuaState) ResumeErr(from *LuaState, nargs int) (yielded bool, nresults int, err error) {
+	var f LuaState
+	if from != nil {
+		f = *from
+	}
+	status := l.Resume(f, nargs, &nresults)
+	switch status {
+	case LUA_OK:
+		return false, nresults, nil
+	case LUA_YIELD:
+		return true, nresults, nil
+	default:
+		C.luaL_traceback(l.luaState, l.luaState, nil, 0)
+		traceback := l.ToString(-1)
+		l.Pop(1)
+		le := l.popError(status)
+		le.Traceback = traceback
+		return false, 0, le
+	}
+}
+
 func (l *LuaState) Rotate(idx, n int) {
 	C.lua_rotate(l.luaState, C.int(idx), C.int(n))
 }
 
-func (l *LuaState) SetAllocF() {
-	//C.lua_setallocf(l.luaState)
-	panic("not implemented")
+// setAllocF replaces the allocator of the state. MemoryUsage and the memory
+// limit stop being updated once the allocator of NewLuaState is replaced.
+func (l *LuaState) setAllocF(f C.lua_Alloc, ud unsafe.Pointer) {
+	C.lua_setallocf(l.luaState, f, ud)
 }
 
 func (l *LuaState) SetField(idx int, k string) {
@@ -565,9 +1365,159 @@ func (l *LuaState) SetGlobal(name string) {
 	C.lua_setglobal(l.luaState, cs)
 }
 
-func (l *LuaState) SetHook() {
-	//C.lua_sethook(l.luaState)
-	panic("not implemented")
+// SetHook sets fn as the debug hook of l. mask is a combination of
+// LUA_MASKCALL, LUA_MASKRET, LUA_MASKLINE and LUA_MASKCOUNT, count is the
+// number of instructions between count events. A nil fn or a zero mask turns
+// the hook off. Threads without a hook of their own, such as coroutines, run
+// the hook of the innermost protected call made from Go on a thread with a
+// hook, or else the hook of the main thread. They are given its events when
+// resumed, the coroutines created before the hook was set included.
+func (l *LuaState) SetHook(mask, count int, fn HookFunc) {
+	h := l.copyHook()
+	if fn == nil || mask == 0 {
+		h.fn, h.mask, h.count = nil, 0, 0
+	} else {
+		h.fn, h.mask, h.count = fn, mask, count
+	}
+	l.installHook(h)
+}
+
+// copyHook returns a copy of the hook of l, or an empty hook.
+func (l *LuaState) copyHook() *luaHook {
+	h := &luaHook{}
+	if old, ok := l.hooks[l.luaState]; ok {
+		*h = *old
+	}
+	return h
+}
+
+// events returns the mask and count to set for h, combining the events asked
+// for by the Go hook with the count events needed by the limits of h.
+func (h *luaHook) events() (mask, count int) {
+	if h.fn != nil {
+		mask, count = h.mask, h.count
+	}
+	if h.limited() {
+		if n := h.checkInterval(); mask&LUA_MASKCOUNT == 0 || n < count {
+			count = n
+		}
+		mask |= LUA_MASKCOUNT
+	}
+	return mask, count
+}
+
+// installHook makes h the hook of l.
+func (l *LuaState) installHook(h *luaHook) {
+	// lua_sethook restarts the count, charge what ran since the last event
+	if old, ok := l.hooks[l.luaState]; ok {
+		old.fuel.charge(int64(C.golua_hookelapsed(l.luaState)))
+	}
+	mask, count := 0, 0
+	if h != nil {
+		mask, count = h.events()
+	}
+	if mask == 0 {
+		delete(l.hooks, l.luaState)
+		l.cstate.hooks = C.int(len(l.hooks))
+		C.lua_sethook(l.luaState, nil, 0, 0)
+		return
+	}
+	h.pending = 0
+	l.hooks[l.luaState] = h
+	l.cstate.hooks = C.int(len(l.hooks))
+	C.lua_sethook(l.luaState, (C.lua_Hook)(C.golua_hook), C.int(mask), C.int(count))
+}
+
+// hook_callback runs the Go hook of l for golua_hook, it returns
+// GOLUA_ERROR when the hook left an error value to raise.
+//
+//export hook_callback
+func hook_callback(l *C.lua_State, ar *C.lua_Debug) C.int {
+	L := stateOf(l)
+	h, ok := L.hooks[l]
+	if !ok {
+		if h, ok = L.inheritedHook(); !ok {
+			return C.GOLUA_RETURN
+		}
+	}
+	ev := DebugEvent{Event: int(ar.event), CurrentLine: int(ar.currentline), ar: ar}
+	if ev.Event == LUA_HOOKCOUNT && h.limited() {
+		n := int(C.lua_gethookcount(l))
+		h.fuel.charge(int64(n))
+		if err := h.check(L); err != nil {
+			// Check on every instruction from now on so scripts catching
+			// the error with pcall or coroutine.resume are interrupted
+			// again right away, on l and on the thread owning the hook
+			for _, t := range []*C.lua_State{l, L.entry, L.main.luaState} {
+				if t == l || L.hooks[t] == h {
+					C.lua_sethook(t, (C.lua_Hook)(C.golua_hook), C.lua_gethookmask(t), 1)
+				}
+			}
+			L.RaiseError(err)
+			return C.GOLUA_ERROR
+		}
+		// The fuel left may be less than the current interval
+		if _, count := h.events(); count != n {
+			C.lua_sethook(l, (C.lua_Hook)(C.golua_hook), C.lua_gethookmask(l), C.int(count))
+		}
+		// Count events of the Go hook keep their own interval
+		if h.fn == nil || h.mask&LUA_MASKCOUNT == 0 {
+			return C.GOLUA_RETURN
+		}
+		if h.pending += n; h.pending < h.count {
+			return C.GOLUA_RETURN
+		}
+		h.pending = 0
+	}
+	if h.fn == nil {
+		return C.GOLUA_RETURN
+	}
+	if L.callGo(func(L *LuaState) int { h.fn(L, ev); return 0 }) < 0 {
+		return C.GOLUA_ERROR
+	}
+	return C.GOLUA_RETURN
+}
+
+// thread_freed forgets the hook of the thread l, which Lua is freeing.
+//
+//export thread_freed
+func thread_freed(l *C.lua_State) {
+	L := stateOf(l)
+	delete(L.hooks, l)
+	L.cstate.hooks = C.int(len(L.hooks))
+}
+
+// inheritedHook returns the hook run by the threads without one of their own.
+func (l *LuaState) inheritedHook() (*luaHook, bool) {
+	if h, ok := l.hooks[l.entry]; ok {
+		return h, true
+	}
+	h, ok := l.hooks[l.main.luaState]
+	return h, ok
+}
+
+// thread_resumed sets the events of the inherited hook on the coroutine l,
+// which is about to be resumed, unless it has a hook of its own.
+//
+//export thread_resumed
+func thread_resumed(l *C.lua_State) {
+	L := stateOf(l)
+	if _, ok := L.hooks[l]; ok {
+		return
+	}
+	mask, count := 0, 0
+	if h, ok := L.inheritedHook(); ok {
+		mask, count = h.events()
+	}
+	// lua_sethook restarts the count, keep it for coroutines resumed often
+	if C.lua_gethookmask(l) == C.int(mask) && C.lua_gethookcount(l) == C.int(count) {
+		return
+	}
+	if mask == 0 {
+		C.lua_sethook(l, nil, 0, 0)
+		return
+	}
+	C.lua_sethook(l, (C.lua_Hook)(C.golua_hook), C.int(mask), C.int(count))
 }
 
 func (l *LuaState) SetI(idx int, n int64) {
@@ -578,9 +1528,15 @@ func (l *LuaState) SetIUserValue(idx, n int) int {
 	return int(C.lua_setiuservalue(l.luaState, C.int(idx), C.int(n)))
 }
 
-func (l *LuaState) SetLocal() string {
-	//C.lua_setlocal(l.luaState)
-	panic("not implemented")
+// SetLocal pops the value on top of the stack into local n of the activation
+// record ar and returns its name, or returns "" and pops nothing if there is
+// no such local. Unlike GetLocal it needs an activation record, with a nil ar
+// it returns "" and pops nothing.
+func (l *LuaState) SetLocal(ar *DebugInfo, n int) string {
+	if ar == nil || ar.ar == nil {
+		return ""
+	}
+	return goStringOrEmpty(C.lua_setlocal(l.luaState, ar.ar, C.int(n)))
 }
 
 func (l *LuaState) SetMetaTable(objindex int) int {
@@ -615,7 +1571,7 @@ func (l *LuaState) StringToNumber(s string) uint64 {
 }
 
 func (l *LuaState) ToBoolean(idx int) bool {
-	return C.lua_toboolean(l.luaState, C.int(idx)) == LUA_OK
+	return C.lua_toboolean(l.luaState, C.int(idx)) != 0
 }
 
 func (l *LuaState) ToCFunction(idx int) {
@@ -639,15 +1595,27 @@ func (l *LuaState) ToIntegerX(idx int) (int64, bool) {
 	return res, int(ci) != 0
 }
 
+// ToBytes returns a copy of the string at idx, zeros included, or nil when
+// the value is neither a string nor a number. A number is converted to a
+// string in place, like lua_tolstring does.
+func (l *LuaState) ToBytes(idx int) []byte {
+	len := C.size_t(0)
+	res := C.lua_tolstring(l.luaState, C.int(idx), &len)
+	if res == nil {
+		return nil
+	}
+	return C.GoBytes(unsafe.Pointer(res), C.int(len))
+}
+
+// ToLString returns the string at idx, zeros included, or "" when the value
+// is neither a string nor a number, see ToBytes.
 func (l *LuaState) ToLString(idx int) string {
-	// TODO:  Review this
 	len := C.size_t(0)
 	res := C.lua_tolstring(l.luaState, C.int(idx), &len)
 	if res == nil {
 		return ""
-	} else {
-		return C.GoString(res)
 	}
+	return C.GoStringN(res, C.int(len))
 }
 
 func (l *LuaState) ToNumber(idx int) float64 {
@@ -671,7 +1639,8 @@ func (l *LuaState) ToString(idx int) string {
 
 func (l *LuaState) ToThread(idx int) LuaState {
 	return LuaState{
-		luaState: C.lua_tothread(l.luaState, C.int(idx)),
+		luaState:    C.lua_tothread(l.luaState, C.int(idx)),
+		globalState: l.globalState,
 	}
 }
 
@@ -717,13 +1686,53 @@ func (l *LuaState) XMove(to LuaState, n int) {
 	C.lua_xmove(l.luaState, to.luaState, C.int(n))
 }
 
-func (l *LuaState) Yield(nresults int) {
-	l.YieldK(nresults, 0, nil)
+func (l *LuaState) Yield(nresults int) int {
+	return l.YieldK(nresults, 0, nil)
+}
+
+// YieldK yields the coroutine running a Go function called by Lua, passing
+// the nresults values on top of the stack to Resume. It must be used as the
+// return value of the Go function:
+//
+//	return L.YieldK(1, ctx, k)
+//
+// The yield happens once the Go function has returned to C. When the
+// coroutine is resumed k is called with LUA_YIELD and ctx, and its result is
+// the result of the Go function. With a nil k the coroutine continues in the
+// function that called the Go function, receiving the values passed to
+// Resume. A continuation is kept until it runs or Lua collects the coroutine.
+func (l *LuaState) YieldK(nresults int, ctx int, k KFunction) int {
+	l.action = C.golua_Action{what: C.GOLUA_YIELD, nresults: C.int(nresults)}
+	if k != nil {
+		l.action.ctx = l.newContinuation(ctx, k, nresults)
+	}
+	return yieldResult
 }
 
-func (l *LuaState) YieldK(nresults int, ctx int, k func()) int {
-	//C.lua_yieldk(l.luaState)
-	panic("not implemented")
+// newContinuation registers k and returns its lua_KContext. The userdata
+// anchoring it is inserted below the n values on top of the stack, which the
+// call or yield consumes, so it stays in the frame of the Go function until
+// continue_callback removes it.
+func (l *LuaState) newContinuation(ctx int, k KFunction, n int) C.lua_KContext {
+	if !l.CheckStack(1) {
+		panic(errStackOverflow)
+	}
+	l.continuationId++
+	*(*int64)(l.NewUserDataUV(8, 0)) = l.continuationId
+	l.SetLMetaTable(continuationMetaTable)
+	l.Insert(-n - 1)
+	l.continuations[l.continuationId] = continuation{ctx: ctx, k: k, anchor: l.GetTop() - n}
+	return C.lua_KContext(l.continuationId)
+}
+
+//export continuation_gc
+func continuation_gc(l *C.lua_State) C.int {
+	L := stateOf(l)
+	// Scripts can reach __gc with debug.getregistry and pass it anything
+	if id := (*int64)(L.TestUData(1, continuationMetaTable)); id != nil {
+		delete(L.continuations, *id)
+	}
+	return 0
 }
 
 func (l *LuaState) AddChar() {
@@ -799,7 +1808,7 @@ func (l *LuaState) BuffSub() {
 func (l *LuaState) CallMeta(obj int, e string) bool {
 	cs := C.CString(e)
 	defer C.free(unsafe.Pointer(cs))
-	return int(C.luaL_callmeta(l.luaState, C.int(obj), cs)) == LUA_OK
+	return int(C.luaL_callmeta(l.luaState, C.int(obj), cs)) != 0
 }
 
 func (l *LuaState) CheckAny(arg int) {
@@ -811,11 +1820,9 @@ func (l *LuaState) CheckInteger(arg int) int64 {
 }
 
 func (l *LuaState) CheckLString(arg int) string {
-	//len := C.size_t(0)
-	//C.luaL_checklstring(l.luaState, C.int(arg), &len)
-
-	// TODO:  Make sure this is always null terminated
-	return C.GoString(C.luaL_checklstring(l.luaState, C.int(arg), nil))
+	len := C.size_t(0)
+	res := C.luaL_checklstring(l.luaState, C.int(arg), &len)
+	return C.GoStringN(res, C.int(len))
 }
 
 func (l *LuaState) CheckNumber(arg int) float64 {
@@ -855,10 +1862,24 @@ func (l *LuaState) DoFile(path string) bool {
 	return l.LoadFile(path) && l.PCall(0, LUA_MULTRET, 0)
 }
 
+func (l *LuaState) DoFileErr(path string) error {
+	if status := l.loadFileX(path, ""); status != LUA_OK {
+		return l.popError(status)
+	}
+	return l.PCallErr(0, LUA_MULTRET, 0)
+}
+
 func (l *LuaState) DoString(src string) bool {
 	return l.LoadString(src) && l.PCall(0, LUA_MULTRET, 0)
 }
 
+func (l *LuaState) DoStringErr(src string) error {
+	if status := l.loadString(src); status != LUA_OK {
+		return l.popError(status)
+	}
+	return l.PCallErr(0, LUA_MULTRET, 0)
+}
+
 func (l *LuaState) LError() {
 	panic("not implemented, variadic function")
 }
@@ -876,7 +1897,7 @@ func (l *LuaState) FileResult(stat int, fname string) int {
 func (l *LuaState) GetMetaField(obj int, e string) bool {
 	cs := C.CString(e)
 	defer C.free(unsafe.Pointer(cs))
-	return C.luaL_getmetafield(l.luaState, C.int(obj), cs) == LUA_OK
+	return C.luaL_getmetafield(l.luaState, C.int(obj), cs) != LUA_TNIL
 }
 
 func (l *LuaState) LGetMetaTable(name string) bool {
@@ -909,17 +1930,33 @@ func (l *LuaState) LoadBuffer(buff []byte, name string) bool {
 }
 
 func (l *LuaState) LoadBufferX(buff []byte, name, mode string) bool {
+	return l.loadBufferX(buff, name, mode) == LUA_OK
+}
+
+func (l *LuaState) loadBufferX(buff []byte, name, mode string) int {
+	if l.chunkCache != nil && cacheable(buff, mode) {
+		return l.chunkCache.load(l, buff, name, mode)
+	}
+	return l.loadBuffer(buff, name, mode)
+}
+
+// loadBuffer is luaL_loadbufferx, loadBufferX without the chunk cache.
+func (l *LuaState) loadBuffer(buff []byte, name, mode string) int {
 	var cn *C.char = nil
 	var cm *C.char = nil
-	defer C.free(unsafe.Pointer(cn))
-	defer C.free(unsafe.Pointer(cm))
 	if len(name) > 0 {
 		cn = C.CString(name)
+		defer C.free(unsafe.Pointer(cn))
 	}
 	if len(mode) > 0 {
 		cm = C.CString(mode)
+		defer C.free(unsafe.Pointer(cm))
+	}
+	var p *C.char
+	if len(buff) > 0 {
+		p = (*C.char)(unsafe.Pointer(&buff[0]))
 	}
-	return C.luaL_loadbufferx(l.luaState, (*C.char)(unsafe.Pointer(&buff[0])), C.size_t(len(buff)), cn, cm) == LUA_OK
+	return int(C.luaL_loadbufferx(l.luaState, p, C.size_t(len(buff)), cn, cm))
 }
 
 func (l *LuaState) LoadFile(path string) bool {
@@ -927,21 +1964,35 @@ func (l *LuaState) LoadFile(path string) bool {
 }
 
 func (l *LuaState) LoadFileX(path, mode string) bool {
+	return l.loadFileX(path, mode) == LUA_OK
+}
+
+func (l *LuaState) loadFileX(path, mode string) int {
+	if l.chunkCache != nil {
+		// Errors are reported by luaL_loadfilex below
+		if src, err := readChunkFile(path); err == nil && cacheable(src, mode) {
+			return l.chunkCache.load(l, src, "@"+path, mode)
+		}
+	}
 	ps := C.CString(path)
 	defer C.free(unsafe.Pointer(ps))
 	if len(mode) > 0 {
 		cm := C.CString(mode)
 		defer C.free(unsafe.Pointer(cm))
-		return C.luaL_loadfilex(l.luaState, ps, cm) == LUA_OK
+		return int(C.luaL_loadfilex(l.luaState, ps, cm))
 	} else {
-		return C.luaL_loadfilex(l.luaState, ps, nil) == LUA_OK
+		return int(C.luaL_loadfilex(l.luaState, ps, nil))
 	}
 }
 
 func (l *LuaState) LoadString(str string) bool {
-	cs := C.CString(str)
-	defer C.free(unsafe.Pointer(cs))
-	return C.luaL_loadstring(l.luaState, cs) == LUA_OK
+	return l.loadString(str) == LUA_OK
+}
+
+// loadString is luaL_loadstring for strings that may hold zeros, the source
+// is also the chunk name.
+func (l *LuaState) loadString(str string) int {
+	return l.loadBufferX([]byte(str), str, "")
 }
 
 func (l *LuaState) NewLib() {
@@ -959,7 +2010,19 @@ func (l *LuaState) NewLibTable() {
 func (l *LuaState) NewMetaTable(tname string) bool {
 	cs := C.CString(tname)
 	defer C.free(unsafe.Pointer(cs))
-	return C.luaL_newmetatable(l.luaState, cs) == LUA_OK
+	return C.luaL_newmetatable(l.luaState, cs) != 0
+}
+
+func (l *LuaState) SetLMetaTable(tname string) {
+	cs := C.CString(tname)
+	defer C.free(unsafe.Pointer(cs))
+	C.luaL_setmetatable(l.luaState, cs)
+}
+
+func (l *LuaState) TestUData(ud int, tname string) unsafe.Pointer {
+	cs := C.CString(tname)
+	defer C.free(unsafe.Pointer(cs))
+	return C.luaL_testudata(l.luaState, C.int(ud), cs)
 }
 
 func (l *LuaState) OpenLibs() {
@@ -980,8 +2043,6 @@ luaL_pushresultsize
 luaL_ref
 luaL_requiref
 luaL_setfuncs
-luaL_setmetatable
-luaL_testudata
 luaL_tolstring
 luaL_traceback
 luaL_typeerror
@@ -1033,43 +2094,70 @@ func (l *LuaState) PushEnumKey(key string, val int) {
 	l.SetTable(-3)
 }
 
-//export print_stack
-func print_stack(l *C.lua_State) C.int {
-	L := luaMap[l]
-	msg := L.ToLString(1)
-	if len(msg) == 0 { // is error object not a string?
-		// does it have a metamethod that produces a string?
-		if L.CallMeta(1, "__tostring") && L.Type(-1) == LUA_TSTRING {
-			return 1 // that is the message
-		} else {
-			str := fmt.Sprintf("(error object is a %s value)", L.TypeName(L.Type(1)))
-			msg = L.PushString(str)
-		}
+// error_handled saves the error value for CallSafeErr from golua_msghandler
+// and reports whether it is an error raised by RaiseError.
+//
+//export error_handled
+func error_handled(l *C.lua_State) C.int {
+	L := stateOf(l)
+	L.errValue = L.errorValue(1)
+	L.errValueSet = true
+	if e, ok := L.goError(1); ok {
+		L.errCause = e.err
+		return 1
 	}
-	cmsg := C.CString(msg)
-	defer C.free(unsafe.Pointer(cmsg))
-	C.luaL_traceback(l, l, cmsg, 1) // append a standard traceback
-	return 1                        // return the traceback
+	return 0
 }
 
-func (l *LuaState) CallSafe(nargs, nresults int) bool {
+// CallSafeErr calls the function below the nargs arguments in protected mode
+// with a traceback message handler. On failure the error message is popped
+// and returned so that the stack is left as it was before the function and
+// its arguments were pushed.
+func (l *LuaState) CallSafeErr(nargs, nresults int) error {
 	base := l.GetTop() - nargs
-	l.PushCFunction((C.lua_CFunction)(C.print_stack))
+	l.PushCFunction((C.lua_CFunction)(C.golua_msghandler))
 	l.Insert(base)
-	ok := l.PCall(nargs, nresults, base)
-	if !ok {
-		log.Fatalf("%s", l.ToString(-1))
+	l.errValueSet = false
+	status := l.pcallk(nargs, nresults, base)
+	if status != LUA_OK {
+		err := l.popError(status)
+		if l.errValueSet {
+			err.Value = l.errValue
+			err.Cause = l.errCause
+		}
+		l.errValue, l.errValueSet, l.errCause = nil, false, nil
+		l.SetTop(base - 1)
+		return err
 	}
 	l.Remove(base)
-	return ok
+	return nil
+}
+
+func (l *LuaState) CallSafe(nargs, nresults int) bool {
+	if err := l.CallSafeErr(nargs, nresults); err != nil {
+		var le *LuaError
+		if errors.As(err, &le) && len(le.Traceback) > 0 {
+			log.Fatalf("%s\n%s", le.Message, le.Traceback)
+		}
+		log.Fatalf("%s", err)
+		return false
+	}
+	return true
+}
+
+func (l *LuaState) BufferErr(buff []byte) error {
+	if status := l.loadBufferX(buff, "", ""); status != LUA_OK {
+		return fmt.Errorf("error loading bytecode -> %w", l.popError(status))
+	}
+	return l.CallSafeErr(0, LUA_MULTRET)
 }
 
 func (l *LuaState) Buffer(buff []byte) bool {
-	if !l.LoadBuffer(buff, "") {
-		log.Fatalf("error loading bytecode -> %s\n", l.ToString(-1))
+	if err := l.BufferErr(buff); err != nil {
+		log.Fatal(err)
 		return false
 	}
-	return l.CallSafe(0, LUA_MULTRET)
+	return true
 }
 
 func read_file(file string) ([]byte, error) {
@@ -1085,51 +2173,75 @@ func read_file(file string) ([]byte, error) {
 	return buff, nil
 }
 
-func (l *LuaState) BufferFile(file string) bool {
+func (l *LuaState) BufferFileErr(file string) error {
 	buff, err := read_file(file)
 	if err != nil {
-		log.Fatalf("error reading file %s -> %s\n", file, err)
+		return fmt.Errorf("error reading file %s -> %w", file, err)
+	}
+	return l.BufferErr(buff)
+}
+
+func (l *LuaState) BufferFile(file string) bool {
+	if err := l.BufferFileErr(file); err != nil {
+		log.Fatal(err)
 		return false
 	}
-	return l.Buffer(buff)
+	return true
 }
 
-func (l *LuaState) BufferModule(moduleName string, buff []byte) bool {
+func (l *LuaState) BufferModuleErr(moduleName string, buff []byte) error {
 	top := l.GetTop()
+	defer l.SetTop(top)
 	l.GetGlobal("package")
 	l.GetField(-1, "preload")
-	success := false
-	if !l.LoadBuffer(buff, "") {
-		log.Fatalf("error loading bytecode -> %s\n", l.ToString(-1))
-		success = false
-	} else {
-		l.SetField(-2, moduleName)
-		success = true
+	if status := l.loadBufferX(buff, "", ""); status != LUA_OK {
+		return fmt.Errorf("error loading bytecode -> %w", l.popError(status))
 	}
-	l.SetTop(top)
-	return success
+	l.SetField(-2, moduleName)
+	return nil
 }
 
-func (l *LuaState) BufferModuleFile(moduleName, file string) bool {
+func (l *LuaState) BufferModule(moduleName string, buff []byte) bool {
+	if err := l.BufferModuleErr(moduleName, buff); err != nil {
+		log.Fatal(err)
+		return false
+	}
+	return true
+}
+
+func (l *LuaState) BufferModuleFileErr(moduleName, file string) error {
 	buff, err := read_file(file)
 	if err != nil {
-		log.Fatalf("error reading file %s -> %s\n", file, err)
+		return fmt.Errorf("error reading file %s -> %w", file, err)
+	}
+	return l.BufferModuleErr(moduleName, buff)
+}
+
+func (l *LuaState) BufferModuleFile(moduleName, file string) bool {
+	if err := l.BufferModuleFileErr(moduleName, file); err != nil {
+		log.Fatal(err)
 		return false
 	}
-	return l.BufferModule(moduleName, buff)
+	return true
 }
 
-func (l *LuaState) ModuleFile(moduleName, file string) bool {
+func (l *LuaState) ModuleFileErr(moduleName, file string) error {
 	top := l.GetTop()
+	defer l.SetTop(top)
 	l.GetGlobal("package")
 	l.GetField(-1, "preload")
-	if !l.LoadFile(file) {
-		log.Fatalf("error loading bytecode -> %s", l.ToString(-1))
+	if status := l.loadFileX(file, ""); status != LUA_OK {
+		return fmt.Errorf("error loading bytecode -> %w", l.popError(status))
+	}
+	l.SetField(-2, moduleName)
+	return nil
+}
+
+func (l *LuaState) ModuleFile(moduleName, file string) bool {
+	if err := l.ModuleFileErr(moduleName, file); err != nil {
+		log.Fatal(err)
 		return false
-	} else {
-		l.SetField(-2, moduleName)
 	}
-	l.SetTop(top)
 	return true
 }
 
@@ -1147,6 +2259,13 @@ func (l *LuaState) TryLoadString(luaCode string) int {
 	return -1
 }
 
+func (l *LuaState) DoFileSafeErr(luaFile string) error {
+	if status := l.loadFileX(luaFile, ""); status != LUA_OK {
+		return fmt.Errorf("failed to load the file %s: %w", luaFile, l.popError(status))
+	}
+	return l.CallSafeErr(0, LUA_MULTRET)
+}
+
 func (l *LuaState) DoFileSafe(luaFile string) bool {
 	if l.TryLoadFile(luaFile) != -1 {
 		return l.CallSafe(0, LUA_MULTRET)
@@ -1155,37 +2274,64 @@ func (l *LuaState) DoFileSafe(luaFile string) bool {
 	}
 }
 
+func (l *LuaState) DoStringSafeErr(luaCode string) error {
+	if status := l.loadString(luaCode); status != LUA_OK {
+		return fmt.Errorf("failed to execute the string: %w", l.popError(status))
+	}
+	if err := l.CallSafeErr(0, LUA_MULTRET); err != nil {
+		return fmt.Errorf("failed to execute the string: %w", err)
+	}
+	return nil
+}
+
 func (l *LuaState) DoStringSafe(luaCode string) bool {
-	if !l.DoString(luaCode) {
-		log.Fatalf("Failed to execute the string: %s", l.ToString(-1))
-		l.Pop(1)
+	if err := l.DoStringSafeErr(luaCode); err != nil {
+		log.Fatal(err)
 		return false
-	} else {
-		return true
 	}
+	return true
 }
 
-func (l *LuaState) ModuleFunc(module, function string) {
+// ModuleFuncErr requires the module and pushes the named function from it on
+// top of the module table. On failure nothing is left on the stack.
+func (l *LuaState) ModuleFuncErr(module, function string) error {
+	top := l.GetTop()
 	l.GetGlobal("require")
 	l.PushString(module)
-	l.CallSafe(1, 1)
+	if err := l.CallSafeErr(1, 1); err != nil {
+		return err
+	}
 	if !l.IsTable(-1) {
-		log.Fatalf("The module named %s could not be found\n", module)
-	} else {
-		l.TableFunc(function)
+		l.SetTop(top)
+		return fmt.Errorf("the module named %s could not be found", module)
+	}
+	if err := l.TableFuncErr(function); err != nil {
+		l.SetTop(top)
+		return err
 	}
+	return nil
 }
 
-func (l *LuaState) TableFunc(function string) {
+func (l *LuaState) ModuleFunc(module, function string) {
+	if err := l.ModuleFuncErr(module, function); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// TableFuncErr pushes the named function from the table on top of the stack.
+// On failure nothing is left on the stack.
+func (l *LuaState) TableFuncErr(function string) error {
 	l.GetField(-1, function)
 	if !l.IsFunction(-1) {
-		log.Fatalf("The function named %s was not found in the table\n", function)
-	} else {
-		//lua_pushcfunction(lua, (lua_CFunction)local_print_stack);
-		//lua_pushvalue(lua, -2);	// Copy luaClass on top of the stack
-		//lua_pcall(lua, 0, 0, -2);
-		//if (lua_pcall(lua, 0, 0, -2) != 0)
-		//	log_err("Error calling %s::%s\n", module, func);
+		l.Pop(1)
+		return fmt.Errorf("the function named %s was not found in the table", function)
+	}
+	return nil
+}
+
+func (l *LuaState) TableFunc(function string) {
+	if err := l.TableFuncErr(function); err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -1194,67 +2340,127 @@ func (l *LuaState) SetGlobalFunction(name string, fn func(*LuaState) int) {
 	l.SetGlobal(name)
 }
 
+func (l *LuaState) ArrayLengthErr(offset int) (int, error) {
+	if !l.IsTable(offset) {
+		return 0, errors.New("expected an array but a table was not found at the offset")
+	}
+	return int(l.RawLen(offset)), nil
+}
+
 func (l *LuaState) ArrayLength(offset int) int {
-	if l.IsTable(offset) {
-		return int(l.RawLen(offset))
-	} else {
-		log.Fatal("Expected an array but a table was not found at the offset")
-		return 0
+	count, err := l.ArrayLengthErr(offset)
+	if err != nil {
+		log.Fatal(err)
 	}
+	return count
+}
+
+// getField pushes the field of the value at offset like GetField, running
+// its __index metamethod, but in protected mode so that a failed lookup is
+// returned instead of raised. On failure nothing is pushed.
+func (l *LuaState) getField(field string, offset int) error {
+	offset = l.AbsIndex(offset)
+	if !l.CheckStack(3) {
+		return errStackOverflow
+	}
+	l.PushCFunction((C.lua_CFunction)(C.golua_gettable))
+	l.PushValue(offset)
+	l.PushString(field)
+	if status := l.pcallk(2, 1, 0); status != LUA_OK {
+		return fmt.Errorf("cannot read the field %s: %w", field, l.popError(status))
+	}
+	return nil
+}
+
+func (l *LuaState) FieldArrayLengthErr(field string, offset int) (int, error) {
+	if err := l.getField(field, offset); err != nil {
+		return 0, err
+	}
+	defer l.Pop(1)
+	return l.ArrayLengthErr(-1)
 }
 
 func (l *LuaState) FieldArrayLength(field string, offset int) int {
-	l.GetField(offset, field)
-	count := l.ArrayLength(-1)
-	l.Pop(1)
+	count, err := l.FieldArrayLengthErr(field, offset)
+	if err != nil {
+		log.Fatal(err)
+	}
 	return count
 }
 
+func (l *LuaState) FieldUserDataErr(field string, offset int) (unsafe.Pointer, error) {
+	if err := l.getField(field, offset); err != nil {
+		return nil, err
+	}
+	defer l.Pop(1)
+	if !l.IsLightUserData(-1) {
+		return nil, errors.New("there was an error reading the user data value")
+	}
+	return l.ToUserData(-1), nil
+}
+
 func (l *LuaState) FieldUserData(field string, offset int) unsafe.Pointer {
-	var result unsafe.Pointer = nil
-	l.GetField(offset, field)
-	if l.IsLightUserData(-1) {
-		result = l.ToUserData(-1)
-	} else {
-		log.Fatal("There was an error reading the user data value")
+	result, err := l.FieldUserDataErr(field, offset)
+	if err != nil {
+		log.Fatal(err)
 	}
-	l.Pop(1)
 	return result
 }
 
+func (l *LuaState) FieldUserDataAddressErr(field string, offset int) (unsafe.Pointer, error) {
+	if err := l.getField(field, offset); err != nil {
+		return nil, err
+	}
+	defer l.Pop(1)
+	if !l.IsInteger(-1) {
+		return nil, errors.New("there was an error reading the user data address value")
+	}
+	return l.ToUserDataAddress(-1), nil
+}
+
 func (l *LuaState) FieldUserDataAddress(field string, offset int) unsafe.Pointer {
-	var result unsafe.Pointer = nil
-	l.GetField(offset, field)
-	if l.IsLightUserData(-1) {
-		result = l.ToUserDataAddress(-1)
-	} else {
-		log.Fatal("There was an error reading the user data value")
+	result, err := l.FieldUserDataAddressErr(field, offset)
+	if err != nil {
+		log.Fatal(err)
 	}
-	l.Pop(1)
 	return result
 }
 
+func (l *LuaState) FieldBoolErr(field string, alt bool, offset int) (bool, error) {
+	if err := l.getField(field, offset); err != nil {
+		return alt, err
+	}
+	defer l.Pop(1)
+	if !l.IsBoolean(-1) {
+		return alt, errors.New("there was an error reading the boolean value")
+	}
+	return l.ToBoolean(-1), nil
+}
+
 func (l *LuaState) FieldBool(field string, alt bool, offset int) bool {
-	result := alt
-	l.GetField(offset, field)
-	if l.IsBoolean(-1) {
-		result = l.ToBoolean(-1)
-	} else {
-		log.Fatal("There was an error reading the boolean value")
+	result, err := l.FieldBoolErr(field, alt, offset)
+	if err != nil {
+		log.Fatal(err)
 	}
-	l.Pop(1)
 	return result
 }
 
+func (l *LuaState) FieldIntErr(field string, alt int, offset int) (int, error) {
+	if err := l.getField(field, offset); err != nil {
+		return alt, err
+	}
+	defer l.Pop(1)
+	if !l.IsNumber(-1) {
+		return alt, errors.New("there was an error reading the integer value")
+	}
+	return l.ToInt(-1), nil
+}
+
 func (l *LuaState) FieldInt(field string, alt int, offset int) int {
-	result := alt
-	l.GetField(offset, field)
-	if l.IsNumber(-1) {
-		result = l.ToInt(-1)
-	} else {
-		log.Fatal("There was an error reading the integer value")
+	result, err := l.FieldIntErr(field, alt, offset)
+	if err != nil {
+		log.Fatal(err)
 	}
-	l.Pop(1)
 	return result
 }
 
@@ -1262,42 +2468,67 @@ type Float interface {
 	float32 | float64
 }
 
+func (l *LuaState) FieldFloat32Err(field string, alt float32, offset int) (float32, error) {
+	if err := l.getField(field, offset); err != nil {
+		return alt, err
+	}
+	defer l.Pop(1)
+	if !l.IsNumber(-1) {
+		return alt, errors.New("there was an error reading the float value")
+	}
+	return l.ToFloat32(-1), nil
+}
+
 func (l *LuaState) FieldFloat32(field string, alt float32, offset int) float32 {
-	result := alt
-	l.GetField(offset, field)
-	if l.IsNumber(-1) {
-		result = l.ToFloat32(-1)
-	} else {
-		log.Fatal("There was an error reading the float value")
+	result, err := l.FieldFloat32Err(field, alt, offset)
+	if err != nil {
+		log.Fatal(err)
 	}
-	l.Pop(1)
 	return result
 }
 
+func (l *LuaState) FieldFloat64Err(field string, alt float64, offset int) (float64, error) {
+	if err := l.getField(field, offset); err != nil {
+		return alt, err
+	}
+	defer l.Pop(1)
+	if !l.IsNumber(-1) {
+		return alt, errors.New("there was an error reading the float value")
+	}
+	return l.ToNumber(-1), nil
+}
+
 func (l *LuaState) FieldFloat64(field string, alt float64, offset int) float64 {
-	result := alt
-	l.GetField(offset, field)
-	if l.IsNumber(-1) {
-		result = l.ToNumber(-1)
-	} else {
-		log.Fatal("There was an error reading the float value")
+	result, err := l.FieldFloat64Err(field, alt, offset)
+	if err != nil {
+		log.Fatal(err)
 	}
-	l.Pop(1)
 	return result
 }
 
+func (l *LuaState) FieldStringErr(field string, alt string, offset int) (string, error) {
+	if err := l.getField(field, offset); err != nil {
+		return alt, err
+	}
+	defer l.Pop(1)
+	if !l.IsString(-1) {
+		return alt, errors.New("there was an error reading the string value")
+	}
+	return l.ToString(-1), nil
+}
+
 func (l *LuaState) FieldString(field string, alt string, offset int) string {
-	result := alt
-	l.GetField(offset, field)
-	if l.IsString(-1) {
-		result = l.ToString(-1)
-	} else {
-		log.Fatal("There was an error reading the string value")
+	result, err := l.FieldStringErr(field, alt, offset)
+	if err != nil {
+		log.Fatal(err)
 	}
-	l.Pop(1)
 	return result
 }
 
+func (l *LuaState) CallFuncErr(nargs, nresults int) error {
+	return l.CallSafeErr(nargs, nresults)
+}
+
 func (l *LuaState) CallFunc(nargs, nresults int) {
 	l.CallSafe(nargs, nresults)
 }
@@ -0,0 +1,52 @@
+/*
+** C side of the Go wrapper, see wrapper.go
+*/
+
+#ifndef wrapper_h
+#define wrapper_h
+
+#include <stdint.h>
+#include "lua.h"
+
+/* Actions requested by a Go function once it has returned to C */
+#define GOLUA_RETURN	0
+#define GOLUA_ERROR	1
+#define GOLUA_YIELD	2
+#define GOLUA_PCALLK	3
+#define GOLUA_CALLK	4
+
+/* Arguments of the action, 'ctx' is the id of a Go continuation or 0 */
+typedef struct golua_Action {
+  int what;
+  int nargs;
+  int nresults;
+  int errfunc;
+  lua_KContext ctx;
+} golua_Action;
+
+int golua_callback(lua_State *L);
+int golua_continue(lua_State *L, int status, lua_KContext ctx);
+void golua_hook(lua_State *L, lua_Debug *ar);
+int golua_msghandler(lua_State *L);
+int golua_gettable(lua_State *L);
+int golua_hookelapsed(lua_State *L);
+/* Bytes in use by a state, its peak and its limit, 0 meaning no limit. The
+   limit is lifted while 'unlimited' is not 0, see golua_enter */
+typedef struct golua_Alloc {
+  size_t used;
+  size_t peak;
+  size_t limit;
+  int unlimited;
+} golua_Alloc;
+void golua_setalloc(lua_State *L, golua_Alloc *a);
+int golua_gc(lua_State *L, int what, int a, int b, int c);
+int golua_dump(lua_State *L, uintptr_t w, int strip);
+int golua_load(lua_State *L, uintptr_t r, const char *chunkname,
+               const char *mode);
+/* Shared by the threads of a state through their extra space: the handle of
+   the Go state and the number of threads with a Go hook */
+typedef struct golua_State { uintptr_t handle; int hooks; } golua_State;
+void golua_setstate(lua_State *L, golua_State *s);
+golua_State *golua_getstate(lua_State *L);
+
+#endif
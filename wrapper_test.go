@@ -0,0 +1,695 @@
+package lua
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unsafe"
+)
+
+func TestFieldErr(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	if err := L.DoStringErr(`
+		config = setmetatable({port = 8080, name = "srv", debug = true, ratio = 0.5, list = {1, 2, 3}},
+			{__index = function() error("no such field") end})`); err != nil {
+		t.Fatal(err)
+	}
+	L.GetGlobal("config")
+	if n, err := L.FieldIntErr("port", 0, -1); err != nil || n != 8080 {
+		t.Errorf("FieldIntErr = %d, %v", n, err)
+	}
+	if s, err := L.FieldStringErr("name", "", -1); err != nil || s != "srv" {
+		t.Errorf("FieldStringErr = %q, %v", s, err)
+	}
+	if b, err := L.FieldBoolErr("debug", false, -1); err != nil || !b {
+		t.Errorf("FieldBoolErr = %v, %v", b, err)
+	}
+	if f, err := L.FieldFloat64Err("ratio", 0, -1); err != nil || f != 0.5 {
+		t.Errorf("FieldFloat64Err = %v, %v", f, err)
+	}
+	if n, err := L.FieldArrayLengthErr("list", -1); err != nil || n != 3 {
+		t.Errorf("FieldArrayLengthErr = %d, %v", n, err)
+	}
+	// Errors raised by __index are returned
+	if n, err := L.FieldIntErr("missing", 7, -1); err == nil || n != 7 {
+		t.Errorf("FieldIntErr of a missing field = %d, %v", n, err)
+	}
+	if L.GetTop() != 1 {
+		t.Errorf("stack has %d values, want 1", L.GetTop())
+	}
+	L.Pop(1)
+
+	// Fields come from __index like with GetField
+	if err := L.DoStringErr(`defaults = setmetatable({}, {__index = {port = 80, name = "def"}})`); err != nil {
+		t.Fatal(err)
+	}
+	L.GetGlobal("defaults")
+	if n := L.FieldInt("port", 0, -1); n != 80 {
+		t.Errorf("FieldInt through __index = %d", n)
+	}
+	if s, err := L.FieldStringErr("name", "", -1); err != nil || s != "def" {
+		t.Errorf("FieldStringErr through __index = %q, %v", s, err)
+	}
+	L.Pop(1)
+
+	// A nil config is an error, not a Lua panic
+	L.PushNil()
+	if n, err := L.FieldIntErr("x", 3, -1); err == nil || n != 3 {
+		t.Errorf("FieldIntErr on nil = %d, %v", n, err)
+	}
+	if _, err := L.FieldStringErr("x", "", -1); err == nil {
+		t.Error("FieldStringErr on nil succeeded")
+	}
+	if _, err := L.FieldArrayLengthErr("x", -1); err == nil {
+		t.Error("FieldArrayLengthErr on nil succeeded")
+	}
+	if _, err := L.FieldUserDataErr("x", -1); err == nil {
+		t.Error("FieldUserDataErr on nil succeeded")
+	}
+	if L.GetTop() != 1 {
+		t.Errorf("stack has %d values, want 1", L.GetTop())
+	}
+}
+
+func TestYieldK(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.SetGlobalFunction("pause", func(L *LuaState) int {
+		L.PushString("paused")
+		return L.YieldK(1, 7, func(L *LuaState, status, ctx int) int {
+			if status != LUA_YIELD || ctx != 7 {
+				t.Errorf("continuation got status %d, ctx %d", status, ctx)
+			}
+			// The stack holds the argument of pause and the resume values
+			L.PushInteger(int64(L.GetTop()) + L.ToInteger(1) + L.ToInteger(-1))
+			return 1
+		})
+	})
+	if err := L.DoStringErr(`
+		local co = coroutine.create(function(n) return pause(n) * 2 end)
+		local ok, v = coroutine.resume(co, 10)
+		assert(ok and v == "paused", v)
+		ok, v = coroutine.resume(co, 100)
+		assert(ok and v == (2 + 10 + 100) * 2, v)
+		assert(coroutine.status(co) == "dead")`); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(L.continuations); n != 0 {
+		t.Errorf("%d continuations left", n)
+	}
+}
+
+func TestResumeErr(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.SetGlobalFunction("pause", func(L *LuaState) int {
+		return L.YieldK(L.GetTop(), 0, func(L *LuaState, status, ctx int) int {
+			return L.GetTop()
+		})
+	})
+	co := L.NewThread()
+	if !co.LoadString(`local a = pause(1, 2) return a * 10`) {
+		t.Fatal("load failed")
+	}
+	yielded, n, err := co.ResumeErr(L, 0)
+	if err != nil || !yielded || n != 2 || co.ToInteger(-1) != 2 {
+		t.Fatalf("first resume = %v, %d, %v", yielded, n, err)
+	}
+	co.Pop(n)
+	co.PushInteger(4)
+	yielded, n, err = co.ResumeErr(L, 1)
+	if err != nil || yielded || n != 1 || co.ToInteger(-1) != 40 {
+		t.Fatalf("second resume = %v, %d, %v", yielded, n, err)
+	}
+	co.Pop(n)
+
+	co2 := L.NewThread()
+	co2.LoadString(`pause() error("late")`)
+	co2.ResumeErr(L, 0)
+	_, _, err = co2.ResumeErr(L, 0)
+	var le *LuaError
+	if !errors.As(err, &le) || !strings.HasSuffix(le.Message, "late") || le.Traceback == "" {
+		t.Errorf("got %v, want the error of the coroutine", err)
+	}
+	if _, _, err := co2.ResumeErr(L, 0); err == nil {
+		t.Error("resuming a dead coroutine succeeded")
+	}
+}
+
+func TestYieldKAbandoned(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.SetGlobalFunction("pause", func(L *LuaState) int {
+		return L.YieldK(0, 0, func(L *LuaState, status, ctx int) int { return 0 })
+	})
+	if err := L.DoStringErr(`
+		for i = 1, 100 do
+			coroutine.resume(coroutine.create(pause))
+		end`); err != nil {
+		t.Fatal(err)
+	}
+	L.GCCollect()
+	if n := len(L.continuations); n != 0 {
+		t.Errorf("%d continuations left after collecting their coroutines", n)
+	}
+	// The __gc of continuations ignores other values
+	if err := L.DoStringErr(`
+		local gc = debug.getregistry()["golua.continuation"].__gc
+		gc(1) gc({}) gc(io.stdout) gc()`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPCallK(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	// try(f, ...) calls f and returns "ok" or "failed" followed by its results
+	L.SetGlobalFunction("try", func(L *LuaState) int {
+		base := L.GetTop() - 1
+		return L.PCallK(base, LUA_MULTRET, 0, base, func(L *LuaState, status, ctx int) int {
+			// LUA_YIELD when the call finished after a yield
+			if status == LUA_OK || status == LUA_YIELD {
+				L.PushString("ok")
+			} else {
+				L.PushString("failed")
+			}
+			L.Insert(1)
+			return L.GetTop()
+		})
+	})
+	if err := L.DoStringErr(`
+		local s, a, b = try(function(x, y) return x + y, x * y end, 3, 4)
+		assert(s == "ok" and a == 7 and b == 12, s)
+		s, a = try(error, "bad", 0)
+		assert(s == "failed" and a == "bad", s)
+		local co = coroutine.wrap(function()
+			return try(function() return coroutine.yield("waiting") .. "!" end)
+		end)
+		assert(co() == "waiting")
+		s, a = co("done")
+		assert(s == "ok" and a == "done!", s)`); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(L.continuations); n != 0 {
+		t.Errorf("%d continuations left", n)
+	}
+}
+
+func TestCallKRaising(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.SetGlobalFunction("call", func(L *LuaState) int {
+		return L.CallK(L.GetTop()-1, LUA_MULTRET, 0, func(L *LuaState, status, ctx int) int {
+			return L.GetTop()
+		})
+	})
+	if err := L.DoStringErr(`
+		assert(select("#", call(function() return 1, 2 end)) == 2)
+		for i = 1, 100 do
+			assert(not pcall(call, error, "bad"))
+		end`); err != nil {
+		t.Fatal(err)
+	}
+	L.GCCollect()
+	if n := len(L.continuations); n != 0 {
+		t.Errorf("%d continuations left after failed calls", n)
+	}
+}
+
+func TestHookOfCollectedThreads(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	lines := 0
+	L.CheckStack(50)
+	for i := 0; i < 50; i++ {
+		th := L.NewThread()
+		th.SetHook(LUA_MASKLINE, 0, func(L *LuaState, ev DebugEvent) { lines++ })
+	}
+	L.Pop(50)
+	if n := len(L.hooks); n != 50 {
+		t.Fatalf("%d hooks set, want 50", n)
+	}
+	L.GCCollect()
+	if n := len(L.hooks); n != 0 {
+		t.Errorf("%d hooks left after collecting their threads", n)
+	}
+	// New threads do not run the hooks of the collected ones
+	if err := L.DoStringErr(`
+		for i = 1, 50 do
+			coroutine.wrap(function()
+				local x = 1
+				return x
+			end)()
+		end`); err != nil {
+		t.Fatal(err)
+	}
+	if lines != 0 {
+		t.Errorf("hooks of collected threads ran %d times", lines)
+	}
+}
+
+func TestGC(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	if !L.GCIsRunning() {
+		t.Fatal("collector not running in a new state")
+	}
+	L.GCStop()
+	if L.GCIsRunning() {
+		t.Error("collector running after GCStop")
+	}
+	// Garbage piles up while the collector is stopped
+	before := L.GCCount()
+	if err := L.DoStringErr(`for i = 1, 1000 do local t = {i} end`); err != nil {
+		t.Fatal(err)
+	}
+	if after := L.GCCount(); after <= before {
+		t.Errorf("GCCount went from %d to %d with the collector stopped", before, after)
+	}
+	L.GCRestart()
+	if !L.GCIsRunning() {
+		t.Error("collector not running after GCRestart")
+	}
+
+	if prev := L.GCGenerational(0, 0); prev != LUA_GCINC {
+		t.Errorf("GCGenerational returned %d, want LUA_GCINC", prev)
+	}
+	if prev := L.GCGenerational(0, 0); prev != LUA_GCGEN {
+		t.Errorf("GCGenerational returned %d, want LUA_GCGEN", prev)
+	}
+	if prev := L.GCIncremental(0, 0, 0); prev != LUA_GCGEN {
+		t.Errorf("GCIncremental returned %d, want LUA_GCGEN", prev)
+	}
+	if prev := L.GCIncremental(0, 0, 0); prev != LUA_GCINC {
+		t.Errorf("GCIncremental returned %d, want LUA_GCINC", prev)
+	}
+
+	// The allocator of NewLuaState sees the same bytes as the collector
+	L.PushString(strings.Repeat("x", 1<<16))
+	if current, _ := L.MemoryUsage(); current != L.GCCount() {
+		t.Errorf("MemoryUsage is %d, GCCount is %d", current, L.GCCount())
+	}
+	L.Pop(1)
+	L.GCCollect()
+	if current, _ := L.MemoryUsage(); current != L.GCCount() {
+		t.Errorf("MemoryUsage is %d after a collection, GCCount is %d", current, L.GCCount())
+	}
+}
+
+func TestDebugInfo(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.SetGlobalFunction("inspect", func(L *LuaState) int {
+		ar, ok := L.GetStack(1)
+		if !ok {
+			t.Fatal("no caller")
+		}
+		if !L.GetInfo("l", ar) || ar.CurrentLine != 3 || ar.Source != "" {
+			t.Errorf("GetInfo(l) = line %d, source %q", ar.CurrentLine, ar.Source)
+		}
+		// Fields of other options are kept when reusing ar
+		if !L.GetInfo("Sn", ar) || ar.Source != "=test" || ar.What != "Lua" || ar.Name != "f" || ar.CurrentLine != 3 {
+			t.Errorf("GetInfo(Sn) = %+v", ar)
+		}
+		if name := L.GetLocal(ar, 1); name != "x" || L.ToInteger(-1) != 1 {
+			t.Errorf("GetLocal = %q, %v", name, L.ToInteger(-1))
+		}
+		L.Pop(1)
+		L.PushInteger(2)
+		if name := L.SetLocal(ar, 1); name != "x" {
+			t.Errorf("SetLocal = %q", name)
+		}
+		top := L.GetTop()
+		if name := L.SetLocal(nil, 1); name != "" || L.GetTop() != top {
+			t.Errorf("SetLocal(nil) = %q, popped %d", name, top-L.GetTop())
+		}
+		return 0
+	})
+	if !L.LoadBuffer([]byte(`local function f()
+		local x = 1
+		inspect()
+		return x
+	end
+	assert(f() == 2)`), "=test") {
+		t.Fatal("load failed")
+	}
+	if err := L.PCallErr(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingWriter fails every write after the first n bytes.
+type failingWriter struct{ n int }
+
+var errWrite = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n < len(p) {
+		return 0, errWrite
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+// panickingWriter panics on every write.
+type panickingWriter struct{}
+
+func (panickingWriter) Write(p []byte) (int, error) {
+	panic("boom")
+}
+
+func TestDump(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	if !L.LoadString(`local a, b = ... return a * b`) {
+		t.Fatal("load failed")
+	}
+	var full, stripped bytes.Buffer
+	if err := L.Dump(&full, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := L.Dump(&stripped, true); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(full.Bytes(), []byte(LUA_SIGNATURE)) || stripped.Len() >= full.Len() {
+		t.Errorf("dumped %d bytes, %d stripped", full.Len(), stripped.Len())
+	}
+	if err := L.Dump(&failingWriter{n: 8}, false); !errors.Is(err, errWrite) {
+		t.Errorf("Dump to a failing writer = %v", err)
+	}
+	var pe *PanicError
+	if err := L.Dump(panickingWriter{}, false); !errors.As(err, &pe) || pe.Value != "boom" {
+		t.Errorf("Dump to a panicking writer = %v", err)
+	}
+	if L.GetTop() != 1 {
+		t.Errorf("stack has %d values, want the function", L.GetTop())
+	}
+	L.Pop(1)
+	for _, bc := range [][]byte{full.Bytes(), stripped.Bytes()} {
+		if !L.LoadBuffer(bc, "=dumped") {
+			t.Fatal("loading the bytecode failed")
+		}
+		L.PushInteger(6)
+		L.PushInteger(7)
+		if err := L.PCallErr(2, 1, 0); err != nil || L.ToInteger(-1) != 42 {
+			t.Errorf("got %d, %v", L.ToInteger(-1), err)
+		}
+		L.Pop(1)
+	}
+	L.GetGlobal("print")
+	if err := L.Dump(&full, false); err == nil {
+		t.Error("Dump of a C function succeeded")
+	}
+}
+
+// panickingReader panics on every read.
+type panickingReader struct{}
+
+func (panickingReader) Read(p []byte) (int, error) {
+	panic("boom")
+}
+
+func TestLoad(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	src := "local n = ...\nreturn n + 1"
+	if err := L.Load(iotest.OneByteReader(strings.NewReader(src)), "=one", ""); err != nil {
+		t.Fatal(err)
+	}
+	var bc bytes.Buffer
+	if err := L.Dump(&bc, false); err != nil {
+		t.Fatal(err)
+	}
+	L.Pop(1)
+	if err := L.Load(&bc, "=bin", "b"); err != nil {
+		t.Fatal(err)
+	}
+	L.PushInteger(41)
+	if err := L.PCallErr(1, 1, 0); err != nil || L.ToInteger(-1) != 42 {
+		t.Errorf("got %d, %v", L.ToInteger(-1), err)
+	}
+	L.Pop(1)
+
+	// Errors leave nothing on the stack
+	err := L.Load(strings.NewReader("return +"), "=bad", "")
+	var le *LuaError
+	if !errors.As(err, &le) || !errors.Is(err, ErrSyntax) || le.Source != "bad" {
+		t.Errorf("got %v, want a syntax error in bad", err)
+	}
+	if err := L.Load(strings.NewReader(src), "=text", "b"); !errors.Is(err, ErrSyntax) {
+		t.Errorf("loading text in mode b = %v", err)
+	}
+	errRead := errors.New("read failed")
+	r := io.MultiReader(strings.NewReader("return "), iotest.ErrReader(errRead))
+	if err := L.Load(r, "=cut", ""); !errors.Is(err, errRead) {
+		t.Errorf("Load from a failing reader = %v", err)
+	}
+	var pe *PanicError
+	r = io.MultiReader(strings.NewReader("return "), panickingReader{})
+	if err := L.Load(r, "=panic", ""); !errors.As(err, &pe) || pe.Value != "boom" {
+		t.Errorf("Load from a panicking reader = %v", err)
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("stack has %d values, want 0", L.GetTop())
+	}
+}
+
+func TestBinaryStrings(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.PushString("a\x00b\x00")
+	if n := L.RawLen(-1); n != 4 {
+		t.Errorf("pushed a string of %d bytes, want 4", n)
+	}
+	if s := L.ToString(-1); s != "a\x00b\x00" {
+		t.Errorf("ToString = %q", s)
+	}
+	L.Pop(1)
+	data := []byte{0, 1, 0, 0xff, 0}
+	L.PushBytes(data)
+	if b := L.ToBytes(-1); !bytes.Equal(b, data) {
+		t.Errorf("ToBytes = %v, want %v", b, data)
+	}
+	L.Pop(1)
+
+	// A raw zero in the source of a chunk
+	if !L.LoadString("return 'x\x00y'") {
+		t.Fatalf("load failed: %s", L.ToString(-1))
+	}
+	if err := L.PCallErr(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if s := L.ToString(-1); s != "x\x00y" {
+		t.Errorf("chunk returned %q", s)
+	}
+	L.Pop(1)
+
+	// string.pack output goes through Go unchanged
+	if err := L.DoStringErr(`packed = string.pack("<i4i2z", 1, 256, "ok")`); err != nil {
+		t.Fatal(err)
+	}
+	L.GetGlobal("packed")
+	want := []byte{1, 0, 0, 0, 0, 1, 'o', 'k', 0}
+	packed := L.ToBytes(-1)
+	if !bytes.Equal(packed, want) {
+		t.Errorf("string.pack gave %v, want %v", packed, want)
+	}
+	L.Pop(1)
+	L.PushBytes(packed)
+	L.SetGlobal("repacked")
+	if err := L.DoStringErr(`
+		local a, b, c = string.unpack("<i4i2z", repacked)
+		assert(a == 1 and b == 256 and c == "ok")`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClosureUpvalueReplaced(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	calls := map[string]int{}
+	for _, name := range []string{"f", "g"} {
+		name := name
+		L.SetGlobalFunction(name, func(L *LuaState) int {
+			calls[name]++
+			return 0
+		})
+	}
+	if err := L.DoStringErr(`
+		local g_id = select(2, debug.getupvalue(g, 1))
+		local f_id = select(2, debug.getupvalue(f, 1))
+		debug.setupvalue(f, 1, "x")
+		local ok, e = pcall(f)
+		assert(not ok and e:find("without its closure id"), e)
+		debug.setupvalue(f, 1, g_id)
+		ok, e = pcall(f)
+		assert(not ok and e:find("closure id of another"), e)
+		debug.setupvalue(f, 1, f_id)
+		f() g()`); err != nil {
+		t.Fatal(err)
+	}
+	if calls["f"] != 1 || calls["g"] != 1 {
+		t.Errorf("calls = %v, want f and g called once", calls)
+	}
+}
+
+func TestClosureCollected(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	base := len(L.closures)
+	for i := 0; i < 100; i++ {
+		L.PushFunction(func(L *LuaState) int { return 0 })
+		L.Pop(1)
+	}
+	if n := len(L.closures) - base; n != 100 {
+		t.Fatalf("%d closures registered, want 100", n)
+	}
+	L.GCCollect()
+	if n := len(L.closures) - base; n != 0 {
+		t.Errorf("%d closures left after collection", n)
+	}
+	// Closures still reachable from Lua are kept
+	L.SetGlobalFunction("keep", func(L *LuaState) int { return 0 })
+	L.GCCollect()
+	if err := L.DoStringErr(`keep()`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReleaseFunction(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	L.SetGlobalFunction("f", func(L *LuaState) int { return 0 })
+	L.GetGlobal("f")
+	n := len(L.closures)
+	if !L.ReleaseFunction(-1) || len(L.closures) != n-1 {
+		t.Error("ReleaseFunction did not release f")
+	}
+	if L.ReleaseFunction(-1) {
+		t.Error("f released twice")
+	}
+	L.Pop(1)
+	L.GetGlobal("print")
+	if L.ReleaseFunction(-1) {
+		t.Error("ReleaseFunction released a C function")
+	}
+	L.Pop(1)
+	err := L.DoStringErr(`f()`)
+	if err == nil || !strings.Contains(err.Error(), "attempt to call a released Go function") {
+		t.Errorf("calling a released function = %v", err)
+	}
+	// The __gc of the closure ids ignores other values
+	if err := L.DoStringErr(`
+		local gc = debug.getmetatable(select(2, debug.getupvalue(f, 1))).__gc
+		gc(1) gc({}) gc(io.stdout) gc()`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGoFunctionOnThreads(t *testing.T) {
+	L := NewLuaState()
+	defer L.Close()
+	var seen []unsafe.Pointer
+	L.SetGlobalFunction("where", func(L *LuaState) int {
+		seen = append(seen, unsafe.Pointer(L.luaState))
+		L.PushBoolean(L.main.luaState == L.luaState)
+		return 1
+	})
+	if err := L.DoStringErr(`
+		assert(where() == true)
+		co = coroutine.create(function()
+			assert(where() == false)
+			coroutine.yield()
+			assert(where() == false)
+		end)
+		assert(coroutine.resume(co))`); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || seen[1] == unsafe.Pointer(L.luaState) {
+		t.Fatalf("Go function ran on %v", seen)
+	}
+	// The coroutine read back with ToThread runs Go functions too
+	L.GetGlobal("co")
+	co := L.ToThread(-1)
+	if unsafe.Pointer(co.luaState) != seen[1] {
+		t.Error("ToThread returned another thread")
+	}
+	if yielded, _, err := co.ResumeErr(L, 0); err != nil || yielded {
+		t.Errorf("resuming through ToThread = %v, %v", yielded, err)
+	}
+	L.Pop(1)
+	// And so do threads made with NewThread
+	th := L.NewThread()
+	th.GetGlobal("where")
+	if err := th.PCallErr(0, 1, 0); err != nil || th.ToBoolean(-1) {
+		t.Errorf("Go function on NewThread = %v, %v", th.ToBoolean(-1), err)
+	}
+	if len(seen) != 4 || seen[3] != unsafe.Pointer(th.luaState) {
+		t.Errorf("Go function ran on %v", seen)
+	}
+}
+
+func TestClose(t *testing.T) {
+	L := NewLuaState()
+	L.SetGlobalFunction("f", func(L *LuaState) int { return 0 })
+	h := L.handle
+	th := L.NewThread()
+	// Closing any thread closes the state
+	th.Close()
+	if L.luaState != nil || L.cstate != nil || L.alloc != nil {
+		t.Error("Close left the C state behind")
+	}
+	if L.closures != nil || L.hooks != nil || L.objects != nil || L.raised != nil || L.continuations != nil {
+		t.Error("Close left the Go values behind")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the handle of the state is still valid")
+			}
+		}()
+		h.Value()
+	}()
+	// Closing again does nothing
+	L.Close()
+	th.Close()
+}
+
+func TestStatesOnGoroutines(t *testing.T) {
+	const states = 8
+	errs := make(chan error, states)
+	for i := 0; i < states; i++ {
+		go func(i int) {
+			L := NewLuaState()
+			defer L.Close()
+			L.SetGlobalFunction("id", func(L *LuaState) int {
+				L.PushInteger(int64(i))
+				return 1
+			})
+			for j := 0; j < 50; j++ {
+				if err := L.DoStringErr(`
+					local co = coroutine.wrap(function() coroutine.yield(id()) end)
+					assert(co() == id())`); err != nil {
+					errs <- err
+					return
+				}
+			}
+			L.GetGlobal("id")
+			if err := L.PCallErr(0, 1, 0); err != nil || L.ToInteger(-1) != int64(i) {
+				errs <- fmt.Errorf("state %d called the function of state %d, %v", i, L.ToInteger(-1), err)
+				return
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < states; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}